@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+)
+
+// accessEntry is a json line of AccessLog
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Query    string    `json:"query,omitempty"`
+	Remote   string    `json:"remote"`
+	Caller   string    `json:"caller,omitempty"`
+	Method   string    `json:"method"`         // of wrpc on /wrpc, of http otherwise
+	Args     []string  `json:"args,omitempty"` // summary, see audit_args
+	ArgSizes []int     `json:"arg_sizes,omitempty"`
+	Status   string    `json:"status"` // of wrpc on /wrpc, of http otherwise
+	Reason   string    `json:"reason,omitempty"`
+	Latency  float64   `json:"latency_ms"`
+	Bytes    int       `json:"bytes"` // of the response
+}
+
+var accessRedactions = map[string]bool{
+	"tokens":   true, // tokens of wsync handshakes and share link ids
+	"payloads": true, // lines of log/append, contents of notifications
+}
+
+// index of the first payload arg of methods
+var payloadArgs = map[string]int{
+	"log/append":      1,
+	"notify":          0,
+	"notify/schedule": 2,
+	"admin/boardcast": 1,
+}
+
+// paths whose rest is a share link id
+var sharePaths = []string{"/share/", "/api/share/"}
+
+const redacted = "REDACTED"
+
+// accessLog writes entries of /wrpc calls, /wsync handshakes, share pages
+// and /api/* requests. Successful ones are sampled, failed ones are all kept. Entries
+// are dropped rather than slowing requests down when the writer lags.
+type accessLog struct {
+	ch      chan accessEntry
+	sample  float64
+	redact  map[string]bool
+	dropped int64 // atomic
+}
+
+func new_access_log() (*accessLog, error) {
+	var w io.Writer = os.Stdout
+	if AccessLog != "-" {
+		f, err := os.OpenFile(AccessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	l := &accessLog{
+		ch:     make(chan accessEntry, 1000),
+		sample: AccessLogSample,
+		redact: make(map[string]bool),
+	}
+	for _, r := range split_list(AccessLogRedact) {
+		l.redact[r] = true
+	}
+
+	go func() {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for entry := range l.ch {
+			if err := enc.Encode(entry); err != nil {
+				event_log("access_log").Error("access log: ", err)
+			}
+			if n := atomic.SwapInt64(&l.dropped, 0); n > 0 {
+				event_log("access_log").WithField("dropped", n).Error("access log: too slow")
+			}
+		}
+	}()
+	return l, nil
+}
+
+func (l *accessLog) add(entry accessEntry, failed bool) {
+	if !failed && rand.Float64() >= l.sample {
+		return
+	}
+	select {
+	case l.ch <- entry:
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+}
+
+func (l *accessLog) redact_args(method string, args []string) []string {
+	from, ok := payloadArgs[method]
+	if !ok || !l.redact["payloads"] || from >= len(args) {
+		return args
+	}
+
+	ret := append([]string(nil), args[:from]...)
+	for _, arg := range args[from:] {
+		ret = append(ret, "["+strconv.Itoa(len(arg))+" bytes]")
+	}
+	return ret
+}
+
+// ObserveRPC is an observer of /wrpc, see rpcObserver
+func (l *accessLog) ObserveRPC(call rpcCall) {
+	caller, _ := wrbac.FromToken(call.Req.Token)
+	sizes := make([]int, len(call.Req.Args))
+	for i, arg := range call.Req.Args {
+		sizes[i] = len(arg)
+	}
+	status := string(call.Status)
+	if status == "" {
+		status = "unknown"
+	}
+
+	l.add(accessEntry{
+		Time:     call.Start,
+		Path:     "/wrpc",
+		Remote:   call.Remote,
+		Caller:   caller,
+		Method:   call.Req.Method,
+		Args:     audit_args(l.redact_args(call.Req.Method, call.Req.Args)),
+		ArgSizes: sizes,
+		Status:   status,
+		Reason:   call.Reason,
+		Latency:  float64(call.Latency) / float64(time.Millisecond),
+		Bytes:    call.RespSize,
+	}, call.Status != wrpc.StatusOK)
+}
+
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *accessRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessRecorder) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += n
+	return n, err
+}
+
+// /wsync upgrades its connections
+func (w *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http: hijack is not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (l *accessLog) logged_path(path string) bool {
+	return path == "/wsync" || strings.HasPrefix(path, "/api/") || strings.HasPrefix(path, "/share/")
+}
+
+// Wrap logs requests of /wsync, /share/ and /api/*, /wrpc is left to
+// ObserveRPC
+func (l *accessLog) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.logged_path(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// before handlers move a header token into the query
+		token := header_token(r)
+		if token == "" {
+			token = wsync_token(r)
+		}
+		caller, _ := wrbac.FromToken(token)
+		path, query := r.URL.Path, r.URL.Query()
+		if l.redact["tokens"] {
+			if query.Get("token") != "" {
+				query.Set("token", redacted)
+			}
+			for _, prefix := range sharePaths {
+				if strings.HasPrefix(path, prefix) {
+					path = prefix + redacted
+				}
+			}
+		}
+
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		l.add(accessEntry{
+			Time:    start,
+			Path:    path,
+			Query:   query.Encode(),
+			Remote:  r.RemoteAddr,
+			Caller:  caller,
+			Method:  r.Method,
+			Status:  strconv.Itoa(rec.status),
+			Latency: float64(time.Since(start)) / float64(time.Millisecond),
+			Bytes:   rec.size,
+		}, rec.status >= 400)
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+)
+
+// permission levels of a log, each one includes the lower ones
+var logPermLevel = map[string]int{
+	"read":   1,
+	"append": 2,
+	"admin":  3,
+}
+
+// permission a log method requires on args[0]
+var logMethodPerm = map[string]string{
+	"log/get":        "read",
+	"log/get/after":  "read",
+	"log/stat":       "read",
+	"log/append":     "append",
+	"log/close":      "admin",
+	"log/delete":     "admin",
+	"log/acl":        "admin",
+	"log/acl/grant":  "admin",
+	"log/acl/revoke": "admin",
+	"log/link":       "admin",
+	"log/links":      "admin",
+	"log/unlink":     "admin",
+}
+
+// logACL holds grants of logs to other users (user:{name}) or roles
+// (role:{role}). Owners of a log, by the {name}@ id prefix, are not listed.
+type logACL struct {
+	// Roles returns roles of token's credential, set by EnableAuth
+	Roles func(token string) []string
+
+	lock   sync.RWMutex
+	grants map[string]map[string]string // map[id]map[grantee]perm
+}
+
+func new_log_acl() *logACL {
+	acl := &logACL{
+		Roles: func(token string) []string {
+			return nil
+		},
+		grants: make(map[string]map[string]string),
+	}
+
+	raw, err := ioutil.ReadFile(ACLFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			event_log("acl").Error(err)
+		}
+		return acl
+	}
+	if err := json.Unmarshal(raw, &acl.grants); err != nil {
+		event_log("acl").Error(err)
+	}
+	return acl
+}
+
+// save MUST be called with lock held
+func (acl *logACL) save() {
+	raw, err := json.MarshalIndent(acl.grants, "", "\t")
+	if err == nil {
+		err = write_file_atomic(ACLFile, raw, 0600)
+	}
+	if err != nil {
+		event_log("acl").WithField("file", ACLFile).Error(err)
+	}
+}
+
+func valid_grantee(grantee string) bool {
+	return (strings.HasPrefix(grantee, "user:") && len(grantee) > len("user:")) ||
+		(strings.HasPrefix(grantee, "role:") && len(grantee) > len("role:"))
+}
+
+// Allowed reports whether a grant gives token perm on id
+func (acl *logACL) Allowed(token, id, perm string) bool {
+	name, _ := wrbac.FromToken(token)
+
+	acl.lock.RLock()
+	grants := acl.grants[id]
+	acl.lock.RUnlock()
+	if len(grants) == 0 {
+		return false
+	}
+
+	need := logPermLevel[perm]
+	if logPermLevel[grants["user:"+name]] >= need {
+		return true
+	}
+	for _, role := range acl.Roles(token) {
+		if logPermLevel[grants["role:"+role]] >= need {
+			return true
+		}
+	}
+	return false
+}
+
+// Owner reports whether token owns id or a grant gives it perm
+func (acl *logACL) Owner(token, id, perm string) bool {
+	name, _ := wrbac.FromToken(token)
+	return strings.HasPrefix(id, name+"@") || acl.Allowed(token, id, perm)
+}
+
+func (acl *logACL) Grant(id, grantee, perm string) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	if acl.grants[id] == nil {
+		acl.grants[id] = make(map[string]string)
+	}
+	acl.grants[id][grantee] = perm
+	acl.save()
+}
+
+func (acl *logACL) Revoke(id, grantee string) bool {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	if _, ok := acl.grants[id][grantee]; !ok {
+		return false
+	}
+	delete(acl.grants[id], grantee)
+	if len(acl.grants[id]) == 0 {
+		delete(acl.grants, id)
+	}
+	acl.save()
+	return true
+}
+
+// Drop removes all grants of id, e.g. when it is deleted
+func (acl *logACL) Drop(id string) {
+	acl.lock.Lock()
+	defer acl.lock.Unlock()
+
+	if _, ok := acl.grants[id]; ok {
+		delete(acl.grants, id)
+		acl.save()
+	}
+}
+
+// List returns grantee	perm of id
+func (acl *logACL) List(id string) []string {
+	acl.lock.RLock()
+	defer acl.lock.RUnlock()
+
+	rets := make([]string, 0, len(acl.grants[id]))
+	for grantee, perm := range acl.grants[id] {
+		rets = append(rets, grantee+"\t"+perm)
+	}
+	sort.Strings(rets)
+	return rets
+}
+
+// log/acl|id -> OK{|grantee	perm}
+// log/acl/grant|id|grantee|perm -> OK	grantee: user:{name}|role:{role} perm: read|append|admin
+// log/acl/revoke|id|grantee -> OK
+//
+// Authorization is done by EnableAuth: these methods need admin on id.
+func EnableACL(rpc *wrpc.Server, acl *logACL) {
+	rpc.HandleFunc("log/acl", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+		return wret.OK(acl.List(r.Args[0])...)
+	})
+
+	rpc.HandleFunc("log/acl/grant", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 3 {
+			return wret.Error("args")
+		}
+		id, grantee, perm := r.Args[0], r.Args[1], r.Args[2]
+		if _, ok := logPermLevel[perm]; !ok || !valid_grantee(grantee) {
+			return wret.Error("args")
+		}
+
+		acl.Grant(id, grantee, perm)
+		return wret.OK()
+	})
+
+	rpc.HandleFunc("log/acl/revoke", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 2 {
+			return wret.Error("args")
+		}
+		if !acl.Revoke(r.Args[0], r.Args[1]) {
+			return wret.Error("not_found")
+		}
+		return wret.OK()
+	})
+}
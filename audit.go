@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+)
+
+// AuditLog keeps calls of methods matching AuditMethods, a json
+// webasis.AuditEntry per line. It is in memory, AuditFile keeps every entry
+// and its last auditReplay lines are appended back at boot.
+const AuditLog = SystemName + "@audit"
+
+const (
+	auditMaxArgs   = 4
+	auditMaxArgLen = 64
+	auditReplay    = 1000
+)
+
+// replay_audit appends the last auditReplay lines of AuditFile to AuditLog
+func replay_audit(appendSystem func(id string, logs ...string) error) {
+	f, err := os.Open(AuditFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		event_log("audit").Error(err)
+		return
+	}
+	defer f.Close()
+
+	lines := make([]string, 0, auditReplay)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, MaxContentLength)
+	for scanner.Scan() {
+		if len(lines) == auditReplay {
+			lines = append(lines[:0], lines[1:]...)
+		}
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		event_log("audit").Error(err)
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if err := appendSystem(AuditLog, lines...); err != nil {
+		event_log("audit").Error(err)
+	}
+}
+
+// audit_args keeps the first args and cuts long ones
+func audit_args(args []string) []string {
+	n := len(args)
+	if n > auditMaxArgs {
+		n = auditMaxArgs
+	}
+	summary := make([]string, 0, n+1)
+	for _, arg := range args[:n] {
+		if len(arg) > auditMaxArgLen {
+			cut := auditMaxArgLen
+			for cut > 0 && !utf8.RuneStart(arg[cut]) {
+				cut--
+			}
+			arg = arg[:cut] + "..."
+		}
+		summary = append(summary, arg)
+	}
+	if len(args) > n {
+		summary = append(summary, fmt.Sprintf("(+%d)", len(args)-n))
+	}
+	return summary
+}
+
+// admin/audit[|max_num[|caller[|method_glob]]] -> OK{|json of webasis.AuditEntry}	latest last
+//
+// Only calls served on /wrpc are audited, calls made by the daemon itself
+// are not. Entries are appended to $WEBASIS_AUDIT_FILE first, then to AuditLog.
+func EnableAudit(rpc *wrpc.Server, observer *rpcObserver, appendSystem func(id string, logs ...string) error) {
+	patterns := split_list(AuditMethods)
+	if len(patterns) == 0 {
+		return
+	}
+	replay_audit(appendSystem)
+
+	observer.Add(func(call rpcCall) {
+		if !glob_match_any(patterns, call.Req.Method) {
+			return
+		}
+
+		caller, _ := wrbac.FromToken(call.Req.Token)
+		status := string(call.Status)
+		if status == "" {
+			status = "unknown"
+		}
+		entry := webasis.AuditEntry{
+			Time:    call.Start,
+			Caller:  caller,
+			Method:  call.Req.Method,
+			Args:    audit_args(call.Req.Args),
+			Status:  status,
+			Remote:  call.Remote,
+			Latency: call.Latency.Nanoseconds() / 1e6,
+		}
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			event_log("audit").Error(err)
+			return
+		}
+
+		if err := append_json_line(AuditFile, entry); err != nil {
+			event_log("audit").WithField("entry", string(raw)).Error(err)
+		}
+		if err := appendSystem(AuditLog, string(raw)); err != nil {
+			event_log("audit").WithField("entry", string(raw)).Error(err)
+		}
+	})
+
+	rpc.HandleFunc("admin/audit", func(r wrpc.Req) wrpc.Resp {
+		fields := webasis.Fields(r.Args)
+		max_num := fields.Int(0, 100)
+		caller := fields.Get(1, "")
+		method := fields.Get(2, "")
+		if max_num < 1 {
+			return wret.Error("args")
+		}
+
+		resp := rpc.CallWithoutAuth(wrpc.Req{Method: "log/get", Args: []string{AuditLog}})
+		if resp.Status != wrpc.StatusOK {
+			// nothing audited yet
+			return wret.OK()
+		}
+
+		rets := make([]string, 0)
+		for i := len(resp.Rets) - 1; i >= 0 && len(rets) < max_num; i-- {
+			var entry webasis.AuditEntry
+			if err := json.Unmarshal([]byte(resp.Rets[i]), &entry); err != nil {
+				continue
+			}
+			if caller != "" && entry.Caller != caller {
+				continue
+			}
+			if method != "" && !glob_match(method, entry.Method) {
+				continue
+			}
+			rets = append(rets, resp.Rets[i])
+		}
+		for i, j := 0, len(rets)-1; i < j; i, j = i+1, j-1 {
+			rets[i], rets[j] = rets[j], rets[i]
+		}
+		return wret.OK(rets...)
+	})
+}
+
+func audit() {
+	if len(os.Args) > 1 && (os.Args[1] == "help" || os.Args[1] == "-h") {
+		audit_help()
+		return
+	}
+	fields := webasis.Fields(os.Args[1:])
+
+	entries, err := webasis.AuditQuery(context.TODO(), fields.Int(0, 100), fields.Get(1, ""), fields.Get(2, ""))
+	ExitIfErr(err)
+
+	table := new_output("time", "caller", "method", "args", "status", "remote")
+	for _, entry := range entries {
+		table.AddRow(map[string]interface{}{
+			"time":   entry.Time.Format("2006-01-02 15:04:05"),
+			"caller": entry.Caller,
+			"method": entry.Method,
+			"args":   strings.Join(entry.Args, " "),
+			"status": entry.Status,
+			"remote": entry.Remote,
+		})
+	}
+	table.Print()
+}
+
+func audit_help() {
+	fmt.Println("help:")
+	fmt.Println("\t", cliName+" [max_num [caller [method_glob]]]")
+	exit_usage()
+}
@@ -2,135 +2,560 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/webasis/wrbac"
 	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
 	"github.com/webasis/wsync"
 )
 
 type User struct {
-	Secret string   `json:"secret"`
+	Hash   string   `json:"hash,omitempty"`   // bcrypt hash of the secret
+	Secret string   `json:"secret,omitempty"` // deprecated: plaintext secret
 	Mask   string   `json:"mask"`
 	Roles  []string `json:"roles"`
+	Cert   string   `json:"cert,omitempty"` // subject of a client certificate, e.g. CN=alice,O=ops
 }
 type AuthModel map[string]map[string]User // map[name]map[comment]User
 
-func EnableAuth(rpc *wrpc.Server, sync *wsync.Server) {
-	rbac := wrbac.New()
-	wrbac_register_role(rbac)
-	wrbac_load(rbac)
-	sync.Auth = rbac.AuthSync
-	rpc.Auth = rbac.AuthRPC
+// authConfig is the auth file, see auth_file_sectioned. Other files are a
+// plain AuthModel.
+type authConfig struct {
+	Users AuthModel          `json:"users"`
+	Roles map[string]RoleDef `json:"roles,omitempty"`
 }
 
-func wrbac_check() {
-	rbac := wrbac.New()
-	wrbac_register_role(rbac)
-	wrbac_load(rbac)
+// Verify reports whether token belongs to a user of the model
+func (model AuthModel) Verify(token string) bool {
+	name, secret := wrbac.FromToken(token)
+	for _, user := range model[name] {
+		if user.Match(secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials returns {name}.{comment} of every user
+func (model AuthModel) credentials() map[string]bool {
+	ret := make(map[string]bool)
+	for name, client := range model {
+		for desc := range client {
+			ret[name+"."+desc] = true
+		}
+	}
+	return ret
+}
+
+type authState struct {
+	model  AuthModel
+	roles  map[string]RoleDef // roles of the auth file
+	scoped scopedTokens
+	table  *wrbac.Table
+	tokens *tokenCache
+	certs  map[string]string // map[cert subject]token
+}
+
+func new_auth_state(cfg authConfig, scoped scopedTokens, table *wrbac.Table) *authState {
+	s := &authState{
+		model:  cfg.Users,
+		roles:  cfg.Roles,
+		scoped: scoped,
+		table:  table,
+		tokens: new_token_cache(cfg.Users),
+		certs:  make(map[string]string),
+	}
+	for name, client := range cfg.Users {
+		for desc, user := range client {
+			if user.Cert == "" {
+				continue
+			}
+			token := cert_token(name, desc, user)
+			s.certs[user.Cert] = token
+			s.tokens.Add(token, wrbac.ToToken(name, user.internalSecret()))
+		}
+	}
+	return s
+}
+
+// CertToken returns the token of the credential mapped to a client
+// certificate's subject
+func (s *authState) CertToken(subject string) (string, bool) {
+	token, ok := s.certs[subject]
+	return token, ok
+}
+
+// Resolve returns the internal wrbac token of token, and its scope if token
+// is a scoped token
+func (s *authState) Resolve(token string) (internal string, scope *scopedToken, ok bool) {
+	if scope, ok := s.lookupScoped(token); ok {
+		return scope.internalToken(), scope, true
+	}
+	internal, ok = s.tokens.Resolve(token)
+	return internal, nil, ok
+}
+
+// own_log_id is id as if name owned it, e.g. bob@3 of alice@3, for the role
+// check of a log granted to name
+func own_log_id(name, id string) string {
+	return name + "@" + id[strings.Index(id, "@")+1:]
+}
+
+// Roles returns roles of token's credential
+func (s *authState) Roles(token string) []string {
+	internal, scope, ok := s.Resolve(token)
+	if !ok {
+		return nil
+	}
+	if scope != nil {
+		return scope.Roles
+	}
+	name, _ := wrbac.FromToken(token)
+	for _, user := range s.model[name] {
+		if wrbac.ToToken(name, user.internalSecret()) == internal {
+			return user.Roles
+		}
+	}
+	return nil
+}
+
+// Cheap reports whether Resolve answers token without bcrypt
+func (s *authState) Cheap(token string) bool {
+	if _, ok := s.lookupScoped(token); ok {
+		return true
+	}
+	return s.tokens.Cheap(token)
 }
 
-func wrbac_register_role(rbac *wrbac.Table) {
-	rbac.Register("root", &wrbac.Role{
-		Sync: func(token string, m wsync.AuthMethod, topic string) bool {
+func (s *authState) Verify(token string) bool {
+	if _, ok := s.lookupScoped(token); ok {
+		return true
+	}
+	for _, t := range s.certs {
+		if t == token {
 			return true
-		},
-		RPC: func(r wrpc.Req) bool {
+		}
+	}
+	return s.model.Verify(token)
+}
+
+// a scoped token dies with its credential
+func (s *authState) lookupScoped(token string) (*scopedToken, bool) {
+	scope, ok := s.scoped.Lookup(token, time.Now())
+	if !ok {
+		return nil, false
+	}
+	if _, ok := s.model[scope.Name][scope.Parent]; !ok {
+		return nil, false
+	}
+	return scope, true
+}
+
+// admin/auth/reload -> OK|added|removed	added,removed: {name}.{comment} separated by ','
+//
+// The auth file is reloaded when it changes, on SIGHUP and by admin/auth/reload.
+// An invalid file is rejected and the running model is kept. admin/user/*
+// changes are written back to the auth file, see EnableUserAdmin.
+//
+// Grants of acl allow log methods and log:{id} subscriptions beyond roles.
+// ready returns the error of the last reload of the auth file, nil once it
+// is applied.
+func EnableAuth(rpc *wrpc.Server, sync *wsync.Server, conns *syncConns, acl *logACL) (state func() *authState, ready func() error) {
+	scoped := load_scoped_tokens()
+	cfg, err := get_auth_config()
+	var table *wrbac.Table
+	if err == nil {
+		table, err = wrbac_build(cfg, scoped)
+	}
+	if err != nil {
+		fmt.Printf("\x1b[31m%s\n\x1b[0m", err)
+		os.Exit(1)
+	}
+	print_auth_model(cfg.Users)
+
+	var current atomic.Value // *authState
+	current.Store(new_auth_state(cfg, scoped, table))
+	state = func() *authState {
+		return current.Load().(*authState)
+	}
+
+	acl.Roles = func(token string) []string {
+		return state().Roles(token)
+	}
+
+	// wrbac only knows internal tokens, see tokenCache. A grant of a log
+	// allows the caller what its mask and roles allow on its own logs.
+	sync.Auth = func(token string, m wsync.AuthMethod, topic string) bool {
+		s := state()
+		internal, scope, ok := s.Resolve(token)
+		if !ok || (scope != nil && !scope.AllowTopic(topic)) {
+			return false
+		}
+		if s.table.AuthSync(internal, m, topic) {
 			return true
-		},
-	})
+		}
+		// log:{id} of a shared log, never a bare {id} topic
+		if m == wsync.AuthMethod_Boardcast || !strings.HasPrefix(topic, "log:") {
+			return false
+		}
+		id := topic[len("log:"):]
+		if !acl.Allowed(token, id, "read") {
+			return false
+		}
+		name, _ := wrbac.FromToken(token)
+		return s.table.AuthSync(internal, m, "log:"+own_log_id(name, id))
+	}
+	rpc.Auth = func(r wrpc.Req) bool {
+		s := state()
+		internal, scope, ok := s.Resolve(r.Token)
+		if !ok || (scope != nil && !scope.AllowRPC(r)) {
+			return false
+		}
+		token := r.Token
+		r.Token = internal
+		if s.table.AuthRPC(r) {
+			return true
+		}
+		perm, ok := logMethodPerm[r.Method]
+		if !ok || len(r.Args) == 0 || !acl.Allowed(token, r.Args[0], perm) {
+			return false
+		}
+		name, _ := wrbac.FromToken(token)
+		r.Args = append([]string{own_log_id(name, r.Args[0])}, r.Args[1:]...)
+		return s.table.AuthRPC(r)
+	}
+
+	// swap validates model and makes it the running one, persistModel and
+	// persistScoped write them back to their files first
+	swap := func(from string, cfg authConfig, scoped scopedTokens, persistModel, persistScoped bool) (added, removed []string, err error) {
+		l := event_log("auth").WithField("from", from)
+		model := cfg.Users
 
-	rbac.Register("mask_user", &wrbac.Role{
-		Sync: func(token string, m wsync.AuthMethod, topic string) bool {
-			if m == wsync.AuthMethod_Boardcast {
-				return false
+		table, err := wrbac_build(cfg, scoped)
+		if err == nil && persistModel {
+			err = save_auth_config(cfg)
+		}
+		if err == nil && persistScoped {
+			err = save_scoped_tokens(scoped)
+		}
+		if err != nil {
+			l.Error("auth reload: ", err)
+			return nil, nil, err
+		}
+
+		old := state()
+		next := new_auth_state(cfg, scoped, table)
+		current.Store(next)
+
+		oldCreds, newCreds := old.model.credentials(), model.credentials()
+		for cred := range newCreds {
+			if !oldCreds[cred] {
+				added = append(added, cred)
 			}
-			return true
-		},
-		RPC: func(r wrpc.Req) bool {
-			name, _ := wrbac.FromToken(r.Token)
-
-			switch r.Method {
-			case "log/append", "log/get", "log/close", "log/stat", "log/delete":
-				if len(r.Args) > 0 && strings.HasPrefix(r.Args[0], name+"@") {
-					return true
-				} else {
-					return false
-				}
+		}
+		for cred := range oldCreds {
+			if !newCreds[cred] {
+				removed = append(removed, cred)
 			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
 
-			if strings.HasPrefix(r.Method, "admin") {
-				return false
+		closed := conns.CloseIf(func(token string) bool {
+			return old.Verify(token) && !next.Verify(token)
+		})
+		l.WithField("added", strings.Join(added, ",")).
+			WithField("removed", strings.Join(removed, ",")).
+			WithField("disconnected", closed).
+			Info("auth reload")
+		return added, removed, nil
+	}
+
+	var reloadErr atomic.Value // string, "" when the auth file is applied
+	reloadErr.Store("")
+	ready = func() error {
+		if err := reloadErr.Load().(string); err != "" {
+			return errors.New(err)
+		}
+		return nil
+	}
+
+	reload := func(from string) (added, removed []string, err error) {
+		cfg, err := get_auth_config()
+		if err != nil {
+			event_log("auth").WithField("from", from).Error("auth reload: ", err)
+		} else {
+			added, removed, err = swap(from, cfg, state().scoped, false, false)
+		}
+		if err != nil {
+			reloadErr.Store(err.Error())
+			return nil, nil, err
+		}
+		reloadErr.Store("")
+		return added, removed, nil
+	}
+
+	type authReq struct {
+		mutate       func(model AuthModel) wrpc.Resp
+		mutateScoped func(scoped scopedTokens, model AuthModel) wrpc.Resp
+		ret          chan<- wrpc.Resp
+	}
+	reqs := make(chan authReq)
+
+	// all reloads and changes run in this goroutine
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		modTime := auth_file_mod_time()
+		for {
+			select {
+			case <-hup:
+				modTime = auth_file_mod_time()
+				reload("sighup")
+			case req := <-reqs:
+				if req.mutate == nil && req.mutateScoped == nil {
+					modTime = auth_file_mod_time()
+					added, removed, err := reload("rpc")
+					if err != nil {
+						req.ret <- wret.Error("config", err.Error())
+					} else {
+						req.ret <- wret.OK(strings.Join(added, ","), strings.Join(removed, ","))
+					}
+					continue
+				}
+
+				if req.mutateScoped != nil {
+					s := state()
+					scoped := s.scoped.clone()
+					resp := req.mutateScoped(scoped, s.model)
+					if resp.Status == wrpc.StatusOK {
+						if _, _, err := swap("token", authConfig{Users: s.model, Roles: s.roles}, scoped, false, true); err != nil {
+							resp = wret.IError(err.Error())
+						}
+					}
+					req.ret <- resp
+					continue
+				}
+
+				// the file, not the running model: an edit the watch has not
+				// picked up yet must not be overwritten
+				cfg, err := get_auth_config()
+				if err != nil {
+					req.ret <- wret.Error("config", err.Error())
+					continue
+				}
+				if cfg.Users == nil {
+					cfg.Users = make(AuthModel)
+				}
+				resp := req.mutate(cfg.Users)
+				if resp.Status == wrpc.StatusOK {
+					if _, _, err := swap("admin/user", cfg, state().scoped, true, false); err != nil {
+						resp = wret.Error("config", err.Error())
+					} else {
+						reloadErr.Store("")
+					}
+					modTime = auth_file_mod_time()
+				}
+				req.ret <- resp
+			case <-time.After(AuthWatchInterval):
+				if t := auth_file_mod_time(); !t.Equal(modTime) {
+					modTime = t
+					reload("watch")
+				}
 			}
-			return true
-		},
-	})
+		}
+	}()
 
-	rbac.Register("notification_sender", &wrbac.Role{
-		Sync: func(token string, m wsync.AuthMethod, topic string) bool {
-			return false
-		},
-		RPC: func(r wrpc.Req) bool {
-			return r.Method == "notify"
-		},
+	EnableUserAdmin(rpc, func(mutate func(model AuthModel) wrpc.Resp) wrpc.Resp {
+		ret := make(chan wrpc.Resp, 1)
+		reqs <- authReq{mutate: mutate, ret: ret}
+		return <-ret
+	}, func() AuthModel {
+		return state().model
 	})
-	rbac.Register("notification_receiver", &wrbac.Role{
-		Sync: func(token string, m wsync.AuthMethod, topic string) bool {
-			return true
-		},
-		RPC: func(r wrpc.Req) bool {
-			switch r.Method {
-			case "log/get":
-				return true
-			}
-			return false
-		},
+
+	EnableScopedTokens(rpc, func(mutate func(scoped scopedTokens, model AuthModel) wrpc.Resp) wrpc.Resp {
+		ret := make(chan wrpc.Resp, 1)
+		reqs <- authReq{mutateScoped: mutate, ret: ret}
+		return <-ret
+	}, state)
+
+	rpc.HandleFunc("admin/auth/reload", func(r wrpc.Req) wrpc.Resp {
+		ret := make(chan wrpc.Resp, 1)
+		reqs <- authReq{ret: ret}
+		return <-ret
 	})
+	return state, ready
+}
+
+func auth_file_mod_time() time.Time {
+	info, err := os.Stat(AuthFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// validates the auth file and explains its roles
+func wrbac_check() {
+	cfg, err := get_auth_config()
+	if err == nil {
+		_, err = wrbac_build(cfg, load_scoped_tokens())
+	}
+	if err != nil {
+		fmt.Printf("\x1b[31m%s\n\x1b[0m", err)
+		os.Exit(1)
+	}
+	print_auth_model(cfg.Users)
+	explain_roles(merge_roles(cfg.Roles))
 }
 
-func wrbac_load(rbac *wrbac.Table) {
-	authModel := get_auth_model()
-	configFailure := false
+// wrbac_build validates cfg and loads it into a new table with the scoped
+// tokens whose credential still exists, limited to the credential's roles
+func wrbac_build(cfg authConfig, scoped scopedTokens) (*wrbac.Table, error) {
+	authModel := cfg.Users
+	rbac := wrbac.New()
+	if err := wrbac_register_role(rbac, merge_roles(cfg.Roles)); err != nil {
+		return nil, err
+	}
+
+	errs := make([]string, 0)
+	certs := make(map[string]string) // map[subject]{name}.{comment}
 	for name, client := range authModel {
-		if !configFailure {
-			fmt.Println("name:", name)
+		if name == SystemName {
+			errs = append(errs, fmt.Sprintf("config error: %s is reserved", name))
+		} else if !valid_user_name(name) {
+			errs = append(errs, fmt.Sprintf("config error: %q is not a valid name", name))
 		}
-
 		for desc, user := range client {
+			if user.Hash == "" && user.Secret == "" {
+				errs = append(errs, fmt.Sprintf("config error: %s.%s require hash", name, desc))
+			}
 			if !rbac.Check(user.Mask) {
-				fmt.Printf("\x1b[31mconfig error: %s.%s unregistered_role: %s\n\x1b[0m", name, "<mask>", user.Mask)
-				configFailure = true
+				errs = append(errs, fmt.Sprintf("config error: %s.%s unregistered_role: %s", name, "<mask>", user.Mask))
 			}
 			for _, role := range user.Roles {
 				if !rbac.Check(role) {
-					fmt.Printf("\x1b[31mconfig error: %s.%s unregistered_role: %s\n\x1b[0m", name, desc, role)
-					configFailure = true
+					errs = append(errs, fmt.Sprintf("config error: %s.%s unregistered_role: %s", name, desc, role))
+				}
+			}
+			if user.Cert != "" {
+				if cred, ok := certs[user.Cert]; ok {
+					errs = append(errs, fmt.Sprintf("config error: %s.%s cert already mapped to %s: %s", name, desc, cred, user.Cert))
 				}
+				certs[user.Cert] = name + "." + desc
 			}
 
-			rbac.Load(name, user.Secret, user.Mask, user.Roles...)
-			if !configFailure {
-				fmt.Printf("    %s\t%s\n", desc, wrbac.ToToken(name, user.Secret))
+			rbac.Load(name, user.internalSecret(), user.Mask, user.Roles...)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+
+	for _, t := range scoped {
+		parent, ok := authModel[t.Name][t.Parent]
+		if !ok {
+			continue
+		}
+		owned := make(map[string]bool)
+		for _, role := range parent.Roles {
+			owned[role] = true
+		}
+		roles := make([]string, 0, len(t.Roles))
+		for _, role := range t.Roles {
+			if owned[role] {
+				roles = append(roles, role)
 			}
 		}
+		rbac.Load(t.Name, scopedTokenPrefix+t.Id, parent.Mask, roles...)
 	}
-	if configFailure {
-		os.Exit(1)
+	return rbac, nil
+}
+
+// never prints secrets or tokens
+func print_auth_model(authModel AuthModel) {
+	for name, client := range authModel {
+		fmt.Println("name:", name)
+		for desc, user := range client {
+			fmt.Printf("    %s\t%s\t%s", desc, user.Mask, strings.Join(user.Roles, ","))
+			if user.Cert != "" {
+				fmt.Print("\tcert: " + user.Cert)
+			}
+			if user.Hash == "" {
+				fmt.Print("\t\x1b[33mplaintext secret, use cmd=secret to hash it\x1b[0m")
+			}
+			fmt.Println()
+		}
+	}
+}
+
+// a config without roles is written as a plain AuthModel
+func save_auth_config(cfg authConfig) error {
+	var v interface{} = cfg
+	if len(cfg.Roles) == 0 {
+		v = cfg.Users
 	}
+	raw, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(AuthFile, raw, 0600)
 }
 
-func get_auth_model() AuthModel {
-	var authModel AuthModel
+// auth_file_sectioned reports whether top is an authConfig: its only keys are
+// users and roles and users holds users by name. A plain AuthModel may have a
+// user named users, whose users by comment aren't users by name.
+func auth_file_sectioned(top map[string]json.RawMessage) bool {
+	raw, ok := top["users"]
+	if !ok {
+		return false
+	}
+	for key := range top {
+		if key != "users" && key != "roles" {
+			return false
+		}
+	}
+	var users AuthModel
+	return json.Unmarshal(raw, &users) == nil
+}
+
+func get_auth_config() (authConfig, error) {
 	authJsonData, err := ioutil.ReadFile(AuthFile)
 	if err != nil {
-		fmt.Println("require set $WEBASIS_AUTH_FILE")
-		panic(err)
+		return authConfig{}, fmt.Errorf("require set $WEBASIS_AUTH_FILE: %v", err)
+	}
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(authJsonData, &top); err != nil {
+		return authConfig{}, err
+	}
+	if !auth_file_sectioned(top) {
+		var authModel AuthModel
+		if err := json.Unmarshal(authJsonData, &authModel); err != nil {
+			return authConfig{}, err
+		}
+		return authConfig{Users: authModel}, nil
+	}
+
+	var cfg authConfig
+	if err := json.Unmarshal(authJsonData, &cfg); err != nil {
+		return authConfig{}, err
 	}
-	if err := json.Unmarshal(authJsonData, &authModel); err != nil {
-		panic(err)
+	if cfg.Users == nil {
+		cfg.Users = make(AuthModel)
 	}
-	return authModel
+	return cfg, nil
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetAuthConfigFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webasis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(v string) { AuthFile = v }(AuthFile)
+	AuthFile = filepath.Join(dir, "auth.json")
+
+	tests := []struct {
+		name  string
+		file  string
+		users []string
+		roles int
+	}{
+		{"plain", `{"alice": {"laptop": {"hash": "x", "mask": "", "roles": ["root"]}}}`, []string{"alice"}, 0},
+		{"sectioned", `{"users": {"alice": {"laptop": {"hash": "x", "mask": "", "roles": ["ops"]}}}, "roles": {"ops": {}}}`, []string{"alice"}, 1},
+		{"plain, a user named users", `{"users": {"laptop": {"hash": "x", "mask": "", "roles": ["root"]}}, "bob": {"ci": {"hash": "y", "mask": "", "roles": []}}}`, []string{"bob", "users"}, 0},
+		{"plain, only a user named users", `{"users": {"laptop": {"hash": "x", "mask": "", "roles": ["root"]}}}`, []string{"users"}, 0},
+	}
+
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(AuthFile, []byte(tt.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := get_auth_config()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(cfg.Users) != len(tt.users) || len(cfg.Roles) != tt.roles {
+			t.Errorf("%s: users = %v, %d roles, want %v, %d roles", tt.name, cfg.Users, len(cfg.Roles), tt.users, tt.roles)
+			continue
+		}
+		for _, name := range tt.users {
+			if _, ok := cfg.Users[name]; !ok {
+				t.Errorf("%s: no user %s in %v", tt.name, name, cfg.Users)
+			}
+		}
+	}
+}
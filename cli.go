@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/webasis/webasis/webasis"
+)
+
+// exit codes of every command
+const (
+	exitOK    = 0
+	exitError = 1 // failed, e.g. the daemon returned an error
+	exitUsage = 2 // bad usage
+)
+
+// cliName prefixes usages, e.g. "webasis log"
+var cliName = "webasis"
+
+// helpRequested makes usages exit with exitOK
+var helpRequested = false
+
+func exit_usage() {
+	if helpRequested {
+		os.Exit(exitOK)
+	}
+	os.Exit(exitUsage)
+}
+
+type command struct {
+	Name  string
+	Args  string   // usage of args
+	Short string   // one line description
+	Subs  []string // subcommands, for completion
+	Help  func()   // prints the usage and exits, by default Args and Short
+	Run   func()   // reads its args from os.Args[1:]
+}
+
+func cli_commands() []*command {
+	return []*command{
+		{Name: "daemon", Short: "run the daemon", Run: daemon},
+		{Name: "check", Short: "validate the auth file and explain its roles", Run: wrbac_check},
+		{Name: "secret", Args: "name comment mask {roles}", Short: "generate a token and its auth file entry", Run: gen_secret},
+		{Name: "config", Args: "cmd", Short: "check the daemon's config", Subs: []string{"check"}, Help: config_help, Run: config},
+		{Name: "push", Args: "[name=/dev/stdin]", Short: "push stdin to wsync's notify topic", Run: push},
+		{Name: "client", Short: "interactive wsync client", Run: client},
+		{Name: "watch", Short: "watch the daemon's status", Run: watch},
+		{Name: "rpc", Args: "method {args}", Short: "call a method", Run: rpc},
+		{Name: "log", Args: "cmd {args}", Short: "create, follow and share logs", Subs: []string{"create", "append", "list", "ls", "get", "stat", "stats", "watch", "delete", "remove", "rm", "share", "unshare", "acl", "link", "links", "unlink", "help"}, Help: log_help, Run: log},
+		{Name: "schedule", Args: "cmd {args}", Short: "schedule notifications", Subs: []string{"at", "in", "cron", "list", "ls", "cancel", "rm"}, Help: schedule_help, Run: schedule},
+		{Name: "user", Args: "cmd {args}", Short: "manage users of the auth file", Subs: []string{"list", "ls", "add", "rm", "remove", "delete", "rotate", "roles"}, Help: user_help, Run: user},
+		{Name: "token", Args: "cmd {args}", Short: "mint and revoke scoped tokens", Subs: []string{"mint", "list", "ls", "revoke", "rm"}, Help: token_help, Run: token},
+		{Name: "audit", Args: "[max_num [caller [method_glob]]]", Short: "query the audit log", Help: audit_help, Run: audit},
+		{Name: "health", Args: "[ready|live]", Short: "check a daemon, exit non-zero when it is not ready", Subs: []string{"ready", "live"}, Help: health_help, Run: health},
+		{Name: "profile", Args: "cmd", Short: "list client profiles", Subs: []string{"list", "ls", "show"}, Help: profile_help, Run: profile},
+		{Name: "completion", Args: "bash|zsh|fish", Short: "print a shell completion script", Subs: []string{"bash", "zsh", "fish"}, Run: completion},
+		{Name: "help", Args: "[command]", Short: "show help of a command"},
+	}
+}
+
+func find_command(name string) *command {
+	for _, c := range cli_commands() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (c *command) help() {
+	if c.Help != nil {
+		c.Help()
+		return
+	}
+	fmt.Println("help:")
+	fmt.Println("\t", strings.TrimSpace(cliName+" "+c.Args))
+	fmt.Println("\t", c.Short)
+	exit_usage()
+}
+
+func cli_help() {
+	fmt.Println("usage: webasis [--profile name] [--output table|json|ndjson|tsv] [--debug] command {args}")
+	fmt.Println()
+	for _, c := range cli_commands() {
+		fmt.Printf("  %-11s %s\n", c.Name, c.Short)
+	}
+	fmt.Println()
+	fmt.Println("webasis help command, or webasis command --help, shows help of a command.")
+	fmt.Println("webasis {method} {args} calls a method whose name has a '/', like rpc.")
+	exit_usage()
+}
+
+// global flags, taking a value or not
+var (
+	globalValueFlags = map[string]bool{"profile": true, "output": true}
+	globalBoolFlags  = map[string]string{"debug": "debug", "help": "help", "h": "help"}
+)
+
+// global_flags takes --{name} value, --{name}=value and bool flags from the
+// front of args, up to the command name or a "--", which is dropped
+func global_flags(args []string) (rest []string, flags map[string]string) {
+	flags = make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return args[i+1:], flags
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg || name == "" {
+			return args[i:], flags
+		}
+
+		if eq := strings.Index(name, "="); eq >= 0 && globalValueFlags[name[:eq]] {
+			flags[name[:eq]] = name[eq+1:]
+		} else if globalValueFlags[name] && i+1 < len(args) {
+			flags[name] = args[i+1]
+			i++
+		} else if key, ok := globalBoolFlags[name]; ok {
+			flags[key] = "on"
+		} else {
+			// not ours, e.g. an unknown command
+			return args[i:], flags
+		}
+	}
+	return nil, flags
+}
+
+// cli runs the command of args, or of the cmd env for existing scripts:
+// cmd=log webasis ls is webasis log ls
+func cli(args []string) int {
+	args, flags := global_flags(args[1:])
+	profileName := flags["profile"]
+	debug := flags["debug"] == "on"
+	helpRequested = flags["help"] == "on"
+	if format := flags["output"]; format != "" {
+		if !outputFormats[format] {
+			fmt.Fprintln(os.Stderr, "unknown output format:", format)
+			return exitUsage
+		}
+		OutputFormat = format
+	}
+
+	var c *command
+	if legacy := os.Getenv("cmd"); legacy != "" {
+		if c = find_command(legacy); c == nil {
+			fmt.Fprintln(os.Stderr, "unknown command:", legacy)
+			return exitUsage
+		}
+	} else if len(args) == 0 {
+		cli_help()
+	} else if c = find_command(args[0]); c != nil {
+		cliName += " " + c.Name
+		args = args[1:]
+	} else if strings.Contains(args[0], "/") {
+		c = find_command("rpc")
+	} else {
+		fmt.Fprintf(os.Stderr, "unknown command: %s, see webasis help\n", args[0])
+		return exitUsage
+	}
+
+	if c.Name == "help" {
+		helpRequested = true
+		if len(args) == 0 {
+			cli_help()
+		}
+		target := find_command(args[0])
+		if target == nil {
+			fmt.Fprintln(os.Stderr, "unknown command:", args[0])
+			return exitUsage
+		}
+		cliName = "webasis " + target.Name
+		target.help()
+		return exitOK
+	}
+	// after the command name only a leading --help, -h or -- is ours
+	if len(args) > 0 && (args[0] == "--help" || args[0] == "-h") {
+		helpRequested = true
+	} else if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if helpRequested || (len(args) > 0 && args[0] == "help" && len(c.Subs) > 0) {
+		helpRequested = true
+		c.help()
+		return exitOK
+	}
+
+	// the daemon doesn't use client profiles
+	if c.Name != "daemon" {
+		webasis.ClientConfigFile = ClientConfigFile
+		if profileName == "" {
+			profileName = ClientProfile
+		}
+		if err := webasis.UseProfile(profileName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+	if debug {
+		webasis.Debug = "on"
+	}
+
+	os.Args = append([]string{os.Args[0]}, args...)
+	c.Run()
+	return exitOK
+}
+
+func completion() {
+	shell := ""
+	if len(os.Args) > 1 {
+		shell = os.Args[1]
+	}
+
+	names := make([]string, 0)
+	for _, c := range cli_commands() {
+		names = append(names, c.Name)
+	}
+
+	switch shell {
+	case "bash", "zsh":
+		if shell == "zsh" {
+			fmt.Println("autoload -U +X bashcompinit && bashcompinit")
+		}
+		fmt.Println("_webasis() {")
+		fmt.Println("\tlocal cur=${COMP_WORDS[COMP_CWORD]}")
+		fmt.Println("\tif [ $COMP_CWORD -eq 1 ]; then")
+		fmt.Printf("\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " ")+" --profile --output --debug --help")
+		fmt.Println("\t\treturn")
+		fmt.Println("\tfi")
+		fmt.Println("\tif [ $COMP_CWORD -eq 2 ]; then")
+		fmt.Println("\t\tcase ${COMP_WORDS[1]} in")
+		for _, c := range cli_commands() {
+			if len(c.Subs) > 0 {
+				fmt.Printf("\t\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", c.Name, strings.Join(c.Subs, " "))
+			}
+		}
+		fmt.Printf("\t\thelp) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(names, " "))
+		fmt.Println("\t\tesac")
+		fmt.Println("\tfi")
+		fmt.Println("}")
+		fmt.Println("complete -F _webasis webasis")
+	case "fish":
+		fmt.Printf("complete -c webasis -f -n __fish_use_subcommand -a %q\n", strings.Join(names, " "))
+		fmt.Println("complete -c webasis -l profile -r -d 'client profile'")
+		fmt.Println("complete -c webasis -l output -x -a 'table json ndjson tsv' -d 'output format'")
+		fmt.Println("complete -c webasis -l debug -d 'print calls'")
+		fmt.Println("complete -c webasis -s h -l help -d 'show help'")
+		for _, c := range cli_commands() {
+			if len(c.Subs) > 0 {
+				fmt.Printf("complete -c webasis -f -n '__fish_seen_subcommand_from %s' -a %q\n", c.Name, strings.Join(c.Subs, " "))
+			}
+		}
+	default:
+		find_command("completion").help()
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobalFlags(t *testing.T) {
+	tests := []struct {
+		args  string
+		rest  string
+		flags map[string]string
+	}{
+		{"log ls", "log ls", map[string]string{}},
+		{"--profile staging log ls", "log ls", map[string]string{"profile": "staging"}},
+		{"--output=json --debug -h log", "log", map[string]string{"output": "json", "debug": "on", "help": "on"}},
+		{"--profile staging -- log ls", "log ls", map[string]string{"profile": "staging"}},
+		{"-- --debug", "--debug", map[string]string{}},
+		{"log append 3 --debug --profile x", "log append 3 --debug --profile x", map[string]string{}},
+		{"log append 3 -- x", "log append 3 -- x", map[string]string{}},
+		{"--unknown log", "--unknown log", map[string]string{}},
+		{"--profile", "--profile", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		rest, flags := global_flags(strings.Fields(tt.args))
+		if got := strings.Join(rest, " "); got != tt.rest {
+			t.Errorf("global_flags(%q): rest = %q, want %q", tt.args, got, tt.rest)
+		}
+		if len(flags) != len(tt.flags) {
+			t.Errorf("global_flags(%q): flags = %v, want %v", tt.args, flags, tt.flags)
+			continue
+		}
+		for k, v := range tt.flags {
+			if flags[k] != v {
+				t.Errorf("global_flags(%q): flags = %v, want %v", tt.args, flags, tt.flags)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigFile holds settings of the daemon, the environment overrides them.
+// It has sections of keys, e.g. {"server": {"listen": "0.0.0.0:8111"}}, see
+// configKeys. Values are strings, numbers, booleans (on|off) or lists of
+// strings (joined by ',').
+var ConfigFile = os.Getenv("WEBASIS_CONFIG")
+
+// map[{section}.{key}]env
+var configKeys = map[string]string{
+	"server.listen":              "WEBASIS_LISTEN",
+	"server.public_url":          "WEBASIS_PUBLIC_URL",
+	"server.notification_url":    "WEBASIS_NOTIFICATION_URL",
+	"server.modules":             "WEBASIS_MODULES",
+	"server.read_header_timeout": "WEBASIS_READ_HEADER_TIMEOUT",
+	"server.read_timeout":        "WEBASIS_READ_TIMEOUT",
+	"server.write_timeout":       "WEBASIS_WRITE_TIMEOUT",
+	"server.idle_timeout":        "WEBASIS_IDLE_TIMEOUT",
+	"server.shutdown_timeout":    "WEBASIS_SHUTDOWN_TIMEOUT",
+	"server.ready_timeout":       "WEBASIS_READY_TIMEOUT",
+
+	"tls.enabled":        "WEBASIS_SSL",
+	"tls.cert":           "WEBASIS_SSL_CERT",
+	"tls.key":            "WEBASIS_SSL_KEY",
+	"tls.watch_interval": "WEBASIS_SSL_WATCH_INTERVAL",
+	"tls.min_version":    "WEBASIS_SSL_MIN_VERSION",
+	"tls.ciphers":        "WEBASIS_SSL_CIPHERS",
+	"tls.client_ca":      "WEBASIS_SSL_CLIENT_CA",
+	"tls.client_auth":    "WEBASIS_SSL_CLIENT_AUTH",
+
+	"auth.file":            "WEBASIS_AUTH_FILE",
+	"auth.watch_interval":  "WEBASIS_AUTH_WATCH_INTERVAL",
+	"auth.user_audit_file": "WEBASIS_USER_AUDIT_FILE",
+	"auth.audit_file":      "WEBASIS_AUDIT_FILE",
+	"auth.audit_methods":   "WEBASIS_AUDIT_METHODS",
+	"auth.audit_max_lines": "WEBASIS_AUDIT_MAX_LINES",
+	"auth.metrics":         "WEBASIS_METRICS_AUTH",
+	"auth.token_max_ttl":   "WEBASIS_TOKEN_MAX_TTL",
+
+	"store.acl_file":      "WEBASIS_ACL_FILE",
+	"store.share_file":    "WEBASIS_SHARE_FILE",
+	"store.log_id_file":   "WEBASIS_LOG_ID_FILE",
+	"store.token_file":    "WEBASIS_TOKEN_FILE",
+	"store.prefs_file":    "WEBASIS_PREFS_FILE",
+	"store.schedule_file": "WEBASIS_SCHEDULE_FILE",
+
+	"limits.max_content_length":     "WEBASIS_MAX_CONTENT_LENGTH",
+	"limits.auth_rate":              "WEBASIS_AUTH_RATE",
+	"limits.auth_burst":             "WEBASIS_AUTH_BURST",
+	"limits.notify_sender_rate":     "WEBASIS_NOTIFY_SENDER_RATE",
+	"limits.notify_sender_burst":    "WEBASIS_NOTIFY_SENDER_BURST",
+	"limits.notify_recipient_rate":  "WEBASIS_NOTIFY_RECIPIENT_RATE",
+	"limits.notify_recipient_burst": "WEBASIS_NOTIFY_RECIPIENT_BURST",
+	"limits.max_schedules":          "WEBASIS_MAX_SCHEDULES",
+	"limits.events_max_lines":       "WEBASIS_EVENTS_MAX_LINES",
+
+	"access_log.file":   "WEBASIS_ACCESS_LOG",
+	"access_log.sample": "WEBASIS_ACCESS_LOG_SAMPLE",
+	"access_log.redact": "WEBASIS_ACCESS_LOG_REDACT",
+
+	"notify.dedup_ttl":    "WEBASIS_NOTIFY_DEDUP_TTL",
+	"notify.group_window": "WEBASIS_NOTIFY_GROUP_WINDOW",
+
+	"client.profiles_file": "WEBASIS_CLIENT_CONFIG",
+	"client.profile":       "WEBASIS_PROFILE",
+}
+
+// values of ConfigFile by env, loaded before any setting
+var fileConfig, fileConfigErr = load_config_file()
+
+func load_config_file() (map[string]string, error) {
+	values := make(map[string]string)
+	if ConfigFile == "" {
+		return values, nil
+	}
+
+	raw, err := ioutil.ReadFile(ConfigFile)
+	if err != nil {
+		return values, err
+	}
+	var sections map[string]map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&sections); err != nil {
+		return values, fmt.Errorf("%s: %s", ConfigFile, err)
+	}
+
+	errs := make([]string, 0)
+	for section, keys := range sections {
+		for key, v := range keys {
+			env, ok := configKeys[section+"."+key]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: unknown key: %s.%s", ConfigFile, section, key))
+				continue
+			}
+			value, err := config_value(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s.%s: %s", ConfigFile, section, key, err))
+				continue
+			}
+			values[env] = value
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return values, errors.New(strings.Join(errs, "\n"))
+	}
+	return values, nil
+}
+
+func config_value(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		if v {
+			return "on", nil
+		}
+		return "off", nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", errors.New("require a list of strings")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", errors.New("require a string, number, boolean or list of strings")
+}
+
+// setting is the effective value of an env, for config check
+type setting struct {
+	Env    string
+	Value  string
+	Source string // env|file|default
+	Err    string // invalid value, the default is used
+}
+
+var settings = make(map[string]*setting) // map[env]setting
+
+func lookup_setting(key string) (v, source string) {
+	if v = os.Getenv(key); v != "" {
+		return v, "env"
+	}
+	if v = fileConfig[key]; v != "" {
+		return v, "file"
+	}
+	return "", "default"
+}
+
+func record_setting(key, v, source, err string) {
+	if strings.HasPrefix(key, "WEBASIS_") {
+		settings[key] = &setting{Env: key, Value: v, Source: source, Err: err}
+	}
+}
+
+func getenv(key, defv string) string {
+	v, source := lookup_setting(key)
+	if v == "" {
+		v = defv
+	}
+	record_setting(key, v, source, "")
+	return v
+}
+
+func getenv_int(key string, defv int) int {
+	raw, source := lookup_setting(key)
+	if raw == "" {
+		record_setting(key, strconv.Itoa(defv), source, "")
+		return defv
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		record_setting(key, strconv.Itoa(defv), source, "invalid int: "+raw)
+		return defv
+	}
+	record_setting(key, raw, source, "")
+	return v
+}
+
+func getenv_duration(key string, defv time.Duration) time.Duration {
+	raw, source := lookup_setting(key)
+	if raw == "" {
+		record_setting(key, defv.String(), source, "")
+		return defv
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		record_setting(key, defv.String(), source, "invalid duration: "+raw)
+		return defv
+	}
+	record_setting(key, raw, source, "")
+	return v
+}
+
+func getenv_float(key string, defv float64) float64 {
+	raw, source := lookup_setting(key)
+	if raw == "" {
+		record_setting(key, strconv.FormatFloat(defv, 'g', -1, 64), source, "")
+		return defv
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		record_setting(key, strconv.FormatFloat(defv, 'g', -1, 64), source, "invalid float: "+raw)
+		return defv
+	}
+	record_setting(key, raw, source, "")
+	return v
+}
+
+// modules of the daemon and the ones they need
+var daemonModules = map[string][]string{
+	"log":               nil,
+	"acl":               {"log"},
+	"share":             {"log"},
+	"audit":             {"log"},
+	"events":            {"log"},
+	"notify":            {"log"},
+	"schedule":          {"notify"},
+	"status":            nil,
+	"metrics":           nil,
+	"wlock":             nil,
+	"freetimecollector": nil,
+}
+
+func module_enabled(name string) bool {
+	for _, module := range split_list(Modules) {
+		if module == name {
+			return true
+		}
+	}
+	return false
+}
+
+// config_error validates the effective config
+func config_error() error {
+	errs := make([]string, 0)
+	if fileConfigErr != nil {
+		errs = append(errs, fileConfigErr.Error())
+	}
+	for _, s := range settings {
+		if s.Err != "" {
+			errs = append(errs, fmt.Sprintf("%s: %s", s.Env, s.Err))
+		}
+	}
+
+	for _, module := range split_list(Modules) {
+		deps, ok := daemonModules[module]
+		if !ok {
+			errs = append(errs, "WEBASIS_MODULES: unknown module: "+module)
+			continue
+		}
+		for _, dep := range deps {
+			if !module_enabled(dep) {
+				errs = append(errs, fmt.Sprintf("WEBASIS_MODULES: %s requires %s", module, dep))
+			}
+		}
+	}
+
+	if ServeSSL != "on" && ServeSSL != "off" {
+		errs = append(errs, "WEBASIS_SSL: require on|off")
+	}
+	if ServeSSL == "on" {
+		if _, ok := tlsVersions[SSLMinVersion]; !ok {
+			errs = append(errs, "WEBASIS_SSL_MIN_VERSION: unknown tls version: "+SSLMinVersion)
+		}
+		if _, err := tls_cipher_suites(split_list(SSLCiphers)); err != nil {
+			errs = append(errs, "WEBASIS_SSL_CIPHERS: "+err.Error())
+		}
+		if SSLClientAuth != "optional" && SSLClientAuth != "require" {
+			errs = append(errs, "WEBASIS_SSL_CLIENT_AUTH: require optional|require")
+		}
+	}
+
+	if AccessLogSample < 0 || AccessLogSample > 1 {
+		errs = append(errs, "WEBASIS_ACCESS_LOG_SAMPLE: require 0 to 1")
+	}
+	for _, r := range split_list(AccessLogRedact) {
+		if !accessRedactions[r] {
+			errs = append(errs, "WEBASIS_ACCESS_LOG_REDACT: unknown redaction: "+r)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func config() {
+	cmd := "help"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	switch cmd {
+	case "check":
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		table := new_output("env", "value", "source")
+		for _, key := range keys {
+			s := settings[key]
+			value := s.Value
+			if strings.Contains(s.Env, "TOKEN") && !strings.HasSuffix(s.Env, "_FILE") && !strings.HasSuffix(s.Env, "_TTL") && value != "" {
+				value = "<hidden>"
+			}
+			table.AddRow(map[string]interface{}{
+				"env":    s.Env,
+				"value":  value,
+				"source": s.Source,
+			})
+		}
+		table.Print()
+
+		if err := config_error(); err != nil {
+			fmt.Printf("\x1b[31m%s\n\x1b[0m", err)
+			os.Exit(1)
+		}
+	default:
+		config_help()
+	}
+}
+
+func config_help() {
+	fmt.Println("help:")
+	fmt.Println("\t", cliName+" check")
+	exit_usage()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron is a parsed standard 5 field cron spec: minute hour day month weekday
+type cron struct {
+	minute  [60]bool
+	hour    [24]bool
+	day     [32]bool
+	month   [13]bool
+	weekday [8]bool // 0 and 7 are sunday
+
+	anyDay     bool
+	anyWeekday bool
+}
+
+// supports: *, n, a-b, */step, a-b/step and comma separated lists of them
+func parse_cron_field(field string, min, max int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return errors.New("cron: bad step: " + part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			a, err1 := strconv.Atoi(bounds[0])
+			b, err2 := strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return errors.New("cron: bad range: " + part)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return errors.New("cron: bad value: " + part)
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return errors.New("cron: out of range: " + part)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func parse_cron(spec string) (*cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron: expect 5 fields: minute hour day month weekday")
+	}
+
+	c := &cron{}
+	if err := parse_cron_field(fields[0], 0, 59, c.minute[:]); err != nil {
+		return nil, err
+	}
+	if err := parse_cron_field(fields[1], 0, 23, c.hour[:]); err != nil {
+		return nil, err
+	}
+	if err := parse_cron_field(fields[2], 1, 31, c.day[:]); err != nil {
+		return nil, err
+	}
+	if err := parse_cron_field(fields[3], 1, 12, c.month[:]); err != nil {
+		return nil, err
+	}
+	if err := parse_cron_field(fields[4], 0, 7, c.weekday[:]); err != nil {
+		return nil, err
+	}
+	c.weekday[0] = c.weekday[0] || c.weekday[7]
+	c.anyDay = fields[2] == "*"
+	c.anyWeekday = fields[4] == "*"
+	return c, nil
+}
+
+func (c *cron) matchDay(t time.Time) bool {
+	day, weekday := c.day[t.Day()], c.weekday[int(t.Weekday())]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return weekday
+	case c.anyWeekday:
+		return day
+	default:
+		// like vixie cron: either one matches
+		return day || weekday
+	}
+}
+
+// wall is the wall clock of t, the repeated hour of a DST change has the same one
+func wall(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// advance returns next, or the start of the hour after t when time.Date moved
+// next back before t: a wall clock time missing by a DST gap, e.g. 02:00 of a
+// spring forward, normalizes to the hour before it
+func advance(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Duration(60-t.Minute()) * time.Minute)
+}
+
+// Next returns the first matched time after t, or zero time if none in 5 years.
+// A wall clock time repeated by a DST change matches once.
+func (c *cron) Next(t time.Time) time.Time {
+	from := wall(t)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !c.month[int(t.Month())] {
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.matchDay(t) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.minute[t.Minute()] || !wall(t).After(from) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
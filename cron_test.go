@@ -0,0 +1,228 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int // nil means an error
+	}{
+		{"*", 0, 5, []int{0, 1, 2, 3, 4, 5}},
+		{"3", 0, 59, []int{3}},
+		{"1,3,5", 0, 59, []int{1, 3, 5}},
+		{"2-4", 0, 59, []int{2, 3, 4}},
+		{"*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"10-20/5", 0, 59, []int{10, 15, 20}},
+		{"5/20", 0, 59, []int{5, 25, 45}},
+		{"1-3,10-12/2", 1, 12, []int{1, 2, 3, 10, 12}},
+		{"0-7", 0, 7, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+
+		{"60", 0, 59, nil},
+		{"0", 1, 31, nil},
+		{"5-1", 0, 59, nil},
+		{"1-", 0, 59, nil},
+		{"*/0", 0, 59, nil},
+		{"*/x", 0, 59, nil},
+		{"a", 0, 59, nil},
+		{"", 0, 59, nil},
+	}
+
+	for _, tt := range tests {
+		set := make([]bool, tt.max+1)
+		err := parse_cron_field(tt.field, tt.min, tt.max, set)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parse_cron_field(%q, %d, %d): expect an error", tt.field, tt.min, tt.max)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse_cron_field(%q, %d, %d): %v", tt.field, tt.min, tt.max, err)
+			continue
+		}
+
+		got := make([]int, 0)
+		for v, ok := range set {
+			if ok {
+				got = append(got, v)
+			}
+		}
+		if !equal_ints(got, tt.want) {
+			t.Errorf("parse_cron_field(%q, %d, %d) = %v, want %v", tt.field, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func equal_ints(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"0 9 * * 1-5", true},
+		{"*/5 0-6,22-23 1,15 */3 0", true},
+		{"0 0 * * 7", true},
+
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * 32 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+	}
+
+	for _, tt := range tests {
+		_, err := parse_cron(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("parse_cron(%q): err = %v, want ok = %v", tt.spec, err, tt.ok)
+		}
+	}
+
+	c, err := parse_cron("0 0 * * 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.weekday[0] {
+		t.Error("parse_cron: weekday 7 must match sunday")
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want string // empty means never
+	}{
+		{"next minute", "* * * * *", "2024-01-01 10:00", "2024-01-01 10:01"},
+		{"after, not at", "30 10 * * *", "2024-01-01 10:30", "2024-01-02 10:30"},
+		{"step", "*/15 * * * *", "2024-01-01 10:16", "2024-01-01 10:30"},
+		{"hour rollover", "5 * * * *", "2024-01-01 10:06", "2024-01-01 11:05"},
+		{"day rollover", "0 9 * * *", "2024-01-01 23:59", "2024-01-02 09:00"},
+		{"month rollover", "0 0 1 * *", "2024-01-15 12:00", "2024-02-01 00:00"},
+		{"year rollover", "0 0 1 1 *", "2024-06-01 00:00", "2025-01-01 00:00"},
+		{"skip short months", "0 0 31 * *", "2024-01-31 00:00", "2024-03-31 00:00"},
+		{"leap day", "0 0 29 2 *", "2023-03-01 00:00", "2024-02-29 00:00"},
+		{"month range", "0 0 1 6-8 *", "2024-08-02 00:00", "2025-06-01 00:00"},
+		{"weekday", "0 9 * * 1-5", "2024-01-05 10:00", "2024-01-08 09:00"}, // friday to monday
+		{"sunday as 7", "0 0 * * 7", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"day or weekday", "0 0 13 * 5", "2024-01-06 00:00", "2024-01-12 00:00"}, // friday before the 13th
+		{"day or weekday, the day", "0 0 13 * 5", "2024-01-12 00:00", "2024-01-13 00:00"},
+		{"day, any weekday", "0 0 13 * *", "2024-01-12 00:00", "2024-01-13 00:00"},
+		{"never", "0 0 30 2 *", "2024-01-01 00:00", ""},
+	}
+
+	for _, tt := range tests {
+		c, err := parse_cron(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := c.Next(utc(tt.from))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%s: Next(%s) = %s, want never", tt.name, tt.from, got)
+			}
+			continue
+		}
+		if want := utc(tt.want); !got.Equal(want) {
+			t.Errorf("%s: Next(%s) = %s, want %s", tt.name, tt.from, got, want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata: ", err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04 MST", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from string
+		want string
+	}{
+		// 2024-03-10 02:00 EST jumps to 03:00 EDT
+		{"spring forward, hourly", "0 * * * *", "2024-03-10 01:30 EST", "2024-03-10 03:00 EDT"},
+		{"spring forward, missing time", "30 2 * * *", "2024-03-09 03:00 EST", "2024-03-11 02:30 EDT"},
+		{"spring forward, daily", "0 9 * * *", "2024-03-09 09:00 EST", "2024-03-10 09:00 EDT"},
+		{"spring forward, in the hour before", "45 3 * * *", "2024-03-10 01:31 EST", "2024-03-10 03:45 EDT"},
+		// 2024-11-03 02:00 EDT falls back to 01:00 EST
+		{"fall back, once", "30 1 * * *", "2024-11-03 01:30 EDT", "2024-11-04 01:30 EST"},
+		{"fall back, first", "30 1 * * *", "2024-11-03 00:00 EDT", "2024-11-03 01:30 EDT"},
+		{"fall back, after the repeated hour", "0 * * * *", "2024-11-03 01:50 EDT", "2024-11-03 02:00 EST"},
+		{"fall back, daily", "0 9 * * *", "2024-11-02 09:00 EDT", "2024-11-03 09:00 EST"},
+	}
+
+	for _, tt := range tests {
+		c, err := parse_cron(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got, want := c.Next(at(tt.from)), at(tt.want); !got.Equal(want) {
+			t.Errorf("%s: Next(%s) = %s, want %s", tt.name, tt.from, got.In(loc), want)
+		}
+	}
+}
+
+func TestScheduleNextAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	tests := []struct {
+		spec string
+		want time.Time // zero means an error
+	}{
+		{"09:00", time.Date(2024, 1, 2, 9, 0, 0, 0, time.Local)},
+		{"11:00", time.Date(2024, 1, 1, 11, 0, 0, 0, time.Local)},
+		{"2024-01-01 11:00", time.Date(2024, 1, 1, 11, 0, 0, 0, time.Local)},
+		{"2024-01-01 09:00", time.Time{}},
+		{"2024-01-01 10:00", time.Time{}},
+		{"0", time.Time{}},
+		{"x", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		got, err := schedule_next("at", tt.spec, now)
+		if tt.want.IsZero() {
+			if err == nil {
+				t.Errorf("schedule_next(at, %q) = %s, expect an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("schedule_next(at, %q) = %s, %v, want %s", tt.spec, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/immofon/mlog"
+	"github.com/webasis/webasis/webasis"
+)
+
+// EventLog keeps operational events of the daemon, a json
+// webasis.DaemonEvent per line
+const EventLog = SystemName + "@events"
+
+// events queues events until EnableEvents appends them to EventLog, the
+// oldest ones are kept when it is full
+var events = struct {
+	ch      chan webasis.DaemonEvent
+	dropped int64 // atomic
+}{ch: make(chan webasis.DaemonEvent, 1000)}
+
+// eventEntry logs like mlog.L() and records the event as well
+type eventEntry struct {
+	kind   string
+	fields map[string]interface{}
+	l      *mlog.Entry
+}
+
+// event_log is mlog.L() for events of kind, e.g. event_log("auth")
+func event_log(kind string) *eventEntry {
+	return &eventEntry{kind: kind, l: mlog.L().WithField("kind", kind)}
+}
+
+func (e *eventEntry) WithField(key string, value interface{}) *eventEntry {
+	fields := make(map[string]interface{}, len(e.fields)+1)
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &eventEntry{kind: e.kind, fields: fields, l: e.l.WithField(key, value)}
+}
+
+func (e *eventEntry) emit(level string, args []interface{}) {
+	select {
+	case events.ch <- webasis.DaemonEvent{
+		Time:    time.Now(),
+		Level:   level,
+		Kind:    e.kind,
+		Message: fmt.Sprint(args...),
+		Fields:  e.fields,
+	}:
+	default:
+		atomic.AddInt64(&events.dropped, 1)
+	}
+}
+
+func (e *eventEntry) Info(args ...interface{}) {
+	e.l.Info(args...)
+	e.emit("info", args)
+}
+
+func (e *eventEntry) Warn(args ...interface{}) {
+	e.l.Warn(args...)
+	e.emit("warn", args)
+}
+
+func (e *eventEntry) Error(args ...interface{}) {
+	e.l.Error(args...)
+	e.emit("error", args)
+}
+
+// EnableEvents appends events to EventLog, readable by root with log/get,
+// and records wsync connection churn every minute. flush returns after queued
+// events are appended.
+func EnableEvents(appendSystem func(id string, logs ...string) error, conns *syncConns) (flush func()) {
+	append_event := func(e webasis.DaemonEvent) {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			mlog.L().Error("events: ", err)
+			return
+		}
+		if err := appendSystem(EventLog, string(raw)); err != nil {
+			// not an event, it would fail the same way
+			mlog.L().Error("events: append: ", err)
+		}
+	}
+
+	add := func(e webasis.DaemonEvent) {
+		if n := atomic.SwapInt64(&events.dropped, 0); n > 0 {
+			append_event(webasis.DaemonEvent{
+				Time:    time.Now(),
+				Level:   "warn",
+				Kind:    "events",
+				Message: "dropped",
+				Fields:  map[string]interface{}{"dropped": n},
+			})
+		}
+		append_event(e)
+	}
+
+	flushes := make(chan chan bool)
+	go func() {
+		for {
+			select {
+			case e := <-events.ch:
+				add(e)
+			case done := <-flushes:
+				for len(events.ch) > 0 {
+					add(<-events.ch)
+				}
+				close(done)
+			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			opened, closed, open := conns.Churn()
+			if opened == 0 && closed == 0 {
+				continue
+			}
+			event_log("wsync").
+				WithField("opened", opened).
+				WithField("closed", closed).
+				WithField("open", open).
+				Info("connections")
+		}
+	}()
+
+	return func() {
+		done := make(chan bool)
+		flushes <- done
+		<-done
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/webasis/webasis/webasis"
+)
+
+// readyCheck returns nil when its part of the daemon is ready
+type readyCheck struct {
+	Name  string
+	Check func() error
+}
+
+// readyChecks runs the checks of /readyz. Requests during a run share its
+// results and a check still running from an earlier run is waited for, not
+// started again, so requests can't pile up goroutines on a stuck check.
+type readyChecks struct {
+	checks  []readyCheck
+	pending map[string]chan error // map[name]result, of checks started and not received, used by runs only
+
+	lock    sync.Mutex
+	running chan bool // closed when the run is done, nil between runs
+	results map[string]string
+	ok      bool
+}
+
+func new_ready_checks(checks []readyCheck) *readyChecks {
+	return &readyChecks{
+		checks:  checks,
+		pending: make(map[string]chan error),
+	}
+}
+
+// Check returns map[name]ok|error of a run, started unless one is running
+func (rc *readyChecks) Check() (results map[string]string, ok bool) {
+	rc.lock.Lock()
+	if rc.running == nil {
+		done := make(chan bool)
+		rc.running = done
+		go func() {
+			results, ok := rc.run()
+			rc.lock.Lock()
+			rc.results, rc.ok, rc.running = results, ok, nil
+			rc.lock.Unlock()
+			close(done)
+		}()
+	}
+	done := rc.running
+	rc.lock.Unlock()
+
+	<-done
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.results, rc.ok
+}
+
+// run runs checks at once, a check not done within ReadyTimeout fails
+func (rc *readyChecks) run() (results map[string]string, ok bool) {
+	results = make(map[string]string, len(rc.checks))
+	for _, c := range rc.checks {
+		results[c.Name] = "timeout"
+		if rc.pending[c.Name] == nil {
+			ret := make(chan error, 1)
+			rc.pending[c.Name] = ret
+			go func(c readyCheck) {
+				ret <- c.Check()
+			}(c)
+		}
+	}
+
+	ok = true
+	deadline := time.After(ReadyTimeout)
+	for _, c := range rc.checks {
+		select {
+		case err := <-rc.pending[c.Name]:
+			delete(rc.pending, c.Name)
+			results[c.Name] = "ok"
+			if err != nil {
+				results[c.Name] = err.Error()
+				ok = false
+			}
+		case <-deadline:
+			return results, false
+		}
+	}
+	return results, ok
+}
+
+func write_health(w http.ResponseWriter, health webasis.Health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if health.Status != webasis.HealthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// GET /healthz -> 200 while the process serves http
+// GET /readyz -> 200 when every check passes, 503 with the failed ones
+//
+// Both need no token, for load balancers and systemd.
+func EnableHealth(checks []readyCheck) {
+	ready := new_ready_checks(checks)
+
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		write_health(w, webasis.Health{Status: webasis.HealthOK})
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		results, ok := ready.Check()
+		health := webasis.Health{Status: webasis.HealthOK, Checks: results}
+		if !ok {
+			health.Status = webasis.HealthFail
+		}
+		write_health(w, health)
+	})
+}
+
+func health() {
+	probe := "ready"
+	if len(os.Args) > 1 {
+		probe = os.Args[1]
+	}
+	if probe != "ready" && probe != "live" {
+		health_help()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ReadyTimeout*2)
+	h, err := webasis.CheckHealth(ctx, probe == "live")
+	cancel()
+	if err != nil && !errors.Is(err, webasis.ErrUnhealthy) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+
+	if OutputFormat == "table" {
+		fmt.Println(h.Status)
+		names := make([]string, 0, len(h.Checks))
+		for name := range h.Checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s: %s\n", name, h.Checks[name])
+		}
+	} else {
+		new_output("status", "checks").PrintRow(map[string]interface{}{
+			"status": h.Status,
+			"checks": h.Checks,
+		})
+	}
+	if err != nil {
+		os.Exit(exitError)
+	}
+}
+
+func health_help() {
+	fmt.Println("help:")
+	fmt.Println("\t", cliName+" [ready]")
+	fmt.Println("\t", cliName+" live")
+	exit_usage()
+}
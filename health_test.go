@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadyChecksStuck(t *testing.T) {
+	defer func(v time.Duration) { ReadyTimeout = v }(ReadyTimeout)
+	ReadyTimeout = time.Millisecond * 20
+
+	var started int32
+	unblock := make(chan bool)
+	ready := new_ready_checks([]readyCheck{
+		{"fine", func() error { return nil }},
+		{"stuck", func() error {
+			atomic.AddInt32(&started, 1)
+			<-unblock
+			return nil
+		}},
+	})
+
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			results, ok := ready.Check()
+			if ok || results["stuck"] != "timeout" {
+				t.Errorf("Check() = %v, %v, want stuck to time out", results, ok)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if results, ok := ready.Check(); ok || results["stuck"] != "timeout" {
+		t.Errorf("Check() = %v, %v, want stuck to time out", results, ok)
+	}
+	if n := atomic.LoadInt32(&started); n != 1 {
+		t.Errorf("the stuck check was started %d times, want 1", n)
+	}
+
+	close(unblock)
+	if results, ok := ready.Check(); !ok || results["stuck"] != "ok" {
+		t.Errorf("Check() = %v, %v, want ok", results, ok)
+	}
+}
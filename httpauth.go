@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+)
+
+// header_token returns the token of "Authorization: Bearer {token}" or of
+// basic auth with the user's name and secret, "" if there is none
+func header_token(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	if name, secret, ok := r.BasicAuth(); ok && name != "" {
+		return wrbac.ToToken(name, secret)
+	}
+	return ""
+}
+
+// wrpc_header_auth sets the token of a wrpc request to the header's one.
+// Without the header, the token of the body is used.
+func wrpc_header_auth(h http.Handler, maxContentLength int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := header_token(r)
+		if token == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		var req wrpc.Req
+		err := json.NewDecoder(io.LimitReader(r.Body, maxContentLength)).Decode(&req)
+		r.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req.Token = token
+		raw, err := json.Marshal(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		r.ContentLength = int64(len(raw))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// wsync_header_auth moves the header's token into the handshake, where wsync
+// and syncConns read it
+func wsync_header_auth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := header_token(r); token != "" {
+			query := r.URL.Query()
+			query.Set("token", token)
+			r.URL.RawQuery = query.Encode()
+			r.Header.Del("Authorization")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// request_token returns the token the daemon will verify for r: of the
+// header, of a wsync handshake or of the json body of /wrpc and /api/notify
+func request_token(r *http.Request) string {
+	if token := header_token(r); token != "" {
+		return token
+	}
+	if token := wsync_token(r); token != "" {
+		return token
+	}
+	if r.Method != "POST" || (r.URL.Path != "/wrpc" && r.URL.Path != "/api/notify") {
+		return ""
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(MaxContentLength)+1))
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+	if r.URL.Path == "/wrpc" {
+		var req wrpc.Req
+		json.Unmarshal(raw, &req)
+		return req.Token
+	}
+	var req notifyReq
+	json.Unmarshal(raw, &req)
+	return req.Token
+}
+
+// authLimiter limits tokens of a remote that need bcrypt to be verified, so
+// guessing secrets can't keep the daemon busy. Known tokens and unknown names
+// are free, see tokenCache.
+type authLimiter struct {
+	lock    sync.Mutex
+	remotes map[string]*bucket // map[host]bucket
+}
+
+func new_auth_limiter() *authLimiter {
+	l := &authLimiter{remotes: make(map[string]*bucket)}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			now := time.Now()
+			l.lock.Lock()
+			for host, b := range l.remotes {
+				if now.Sub(b.last) > time.Hour {
+					delete(l.remotes, host)
+				}
+			}
+			l.lock.Unlock()
+		}
+	}()
+	return l
+}
+
+func (l *authLimiter) take(remote string) bool {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.remotes[host]
+	if b == nil {
+		b = &bucket{}
+		l.remotes[host] = b
+	}
+	return b.take(time.Now(), AuthRate, AuthBurst)
+}
+
+// Wrap answers 429 to a request whose token needs bcrypt while its remote is
+// over $WEBASIS_AUTH_RATE
+func (l *authLimiter) Wrap(h http.Handler, state func() *authState) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if AuthRate <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		token := request_token(r)
+		if token != "" && !state().Cheap(token) && !l.take(r.RemoteAddr) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -3,13 +3,15 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	clitable "github.com/crackcomm/go-clitable"
 	"github.com/gorilla/websocket"
 	"github.com/webasis/webasis/webasis"
 	"github.com/webasis/wrbac"
@@ -21,11 +23,22 @@ import (
 type weblog struct {
 	name       string
 	logs       []string
+	dropped    int // oldest lines dropped, logs[0] is line dropped
+	maxLines   int // kept, 0 means unlimited
 	closed     bool
 	alwaysOpen bool
 	created    time.Time
 }
 
+// trim drops the oldest lines above maxLines, line numbers go on
+func (wl *weblog) trim() {
+	if wl.maxLines > 0 && len(wl.logs) > wl.maxLines {
+		n := len(wl.logs) - wl.maxLines
+		wl.logs = wl.logs[n:]
+		wl.dropped += n
+	}
+}
+
 func (wl weblog) size() int {
 	size := len(wl.logs) // size of '\n'
 	for _, l := range wl.logs {
@@ -39,7 +52,8 @@ func (wl weblog) Stat(id string) webasis.WebLogStat {
 		Id:      id,
 		Closed:  wl.closed,
 		Size:    wl.size(),
-		Line:    len(wl.logs),
+		Line:    wl.dropped + len(wl.logs),
+		First:   wl.dropped,
 		Name:    wl.name,
 		Created: wl.created,
 	}
@@ -58,20 +72,65 @@ func new_weblog(name string) *weblog {
 
 const DefaultBufSize = 0
 
+// SystemName owns the logs written by the daemon itself, e.g. system@audit.
+// No user can take it and only the daemon appends to them.
+const SystemName = "system"
+
+func system_log(id string) bool {
+	return strings.HasPrefix(id, SystemName+"@")
+}
+
+// ids of logs are never reused, even though logs are lost on restart:
+// grants and share links of an old log must not apply to a new one.
+// LogIdFile keeps the next one, without it ids start at the current unix
+// time, above ids of earlier runs.
+func load_next_log_id() int {
+	store := struct {
+		NextId int `json:"next_id"`
+	}{}
+	raw, err := ioutil.ReadFile(LogIdFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			event_log("log").WithField("file", LogIdFile).Error(err)
+		}
+		return int(time.Now().Unix())
+	}
+	if err := json.Unmarshal(raw, &store); err != nil || store.NextId < 1 {
+		event_log("log").WithField("file", LogIdFile).Error("bad next_id: ", string(raw))
+		return int(time.Now().Unix())
+	}
+	return store.NextId
+}
+
+func save_next_log_id(nextId int) error {
+	raw, err := json.Marshal(map[string]int{"next_id": nextId})
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(LogIdFile, raw, 0600)
+}
+
 // log/open|name -> OK|id	WSYNC: logs,log:{id}|{line}|{created}
 // log/close|id -> OK	WSYNC: logs,log:{id}|{line}|{created}
-// log/all -> OK{|id,closed,size,name}
-// log/get|id[|start[|max_num[|max_size]]] -> OK{|logs}
-// log/append|id{|logs} -> OK WSYNC: logs,log:{id}|{line}|{created}
-// log/delete|id ->OK WSYNC: logs,log:{id}
-// log/stat|id ->OK|name|size:int|closed:bool|created:int
+// log/all -> OK{|id,closed,size,name}	own logs and logs shared by acl
+// log/get|id[|start[|max_num[|max_size]]] -> OK{|logs}	lines before first are skipped
+// log/append|id{|logs} -> OK WSYNC: logs,log:{id}|{line}|{created}	system logs are refused, see appendSystem
+// log/delete|id ->OK WSYNC: logs,log:{id}	system logs can't be deleted, grants and share links are dropped
+// log/stat|id ->OK|name|size:int|line:int|closed:bool|created:int|first:int	first: the oldest kept line
 // alias: log/get/after -> log/get
-func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
+//
+// appendSystem is how the daemon appends to system logs, no call can.
+// flush returns after queued changes of logs are done.
+func EnableLog(rpc *wrpc.Server, sync *wsync.Server, acl *logACL, links *shareLinks) (appendSystem func(id string, logs ...string) error, flush func()) {
 
 	reserved := func(id string) (is, alwaysOpen bool, name string) {
-		reservedKey := map[string]bool{ // map[id]alwaysOpen
+		reservedKey := map[string]bool{ // map[id]alwaysOpen, of every user
 			"notification": true,
 		}
+		systemKey := map[string]bool{ // map[id]alwaysOpen, of system only
+			"audit":  true,
+			"events": true,
+		}
 		index := strings.Index(id, "@")
 		index++
 		if index <= 0 {
@@ -79,12 +138,15 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 		}
 		name = id[index:]
 		alwaysOpen, is = reservedKey[name]
+		if !is && system_log(id) {
+			alwaysOpen, is = systemKey[name]
+		}
 		name = name + "_log"
 		return
 	}
 
 	weblogs := make(map[string]*weblog) // map[id]Log
-	nextId := 1
+	nextId := load_next_log_id()
 
 	ch := make(chan func(), 1000)
 	go func() {
@@ -93,15 +155,18 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 		}
 	}()
 
-	go_next_id := func(token string) string {
+	go_next_id := func(token string) (string, error) {
+		if err := save_next_log_id(nextId + 1); err != nil {
+			return "", err
+		}
 		id := strconv.Itoa(nextId)
 		nextId++
 
 		name, _ := wrbac.FromToken(token)
-		return name + "@" + id
+		return name + "@" + id, nil
 	}
 
-	get_weblog := func(token, id string) *weblog {
+	get_weblog := func(id string) *weblog {
 		wl := weblogs[id]
 		if wl == nil {
 			is, alwaysOpen, name := reserved(id)
@@ -111,6 +176,12 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 
 			wl = new_weblog(name)
 			wl.alwaysOpen = alwaysOpen
+			switch id {
+			case AuditLog:
+				wl.maxLines = AuditMaxLines
+			case EventLog:
+				wl.maxLines = EventsMaxLines
+			}
 			weblogs[id] = wl
 		}
 		return wl
@@ -123,9 +194,13 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 
 		name := r.Args[0]
 		id := make(chan string, 1)
-		defer close(id)
+		errCh := make(chan error, 1)
 		ch <- func() {
-			new_id := go_next_id(r.Token)
+			new_id, err := go_next_id(r.Token)
+			if err != nil {
+				errCh <- err
+				return
+			}
 			weblog := new_weblog(name)
 			weblogs[new_id] = weblog
 			id <- new_id
@@ -135,7 +210,13 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 				sync.Boardcast("log:"+new_id, webasis.Int(0), webasis.Int(int(weblog.created.Unix())))
 			}
 		}
-		return wret.OK(<-id)
+		select {
+		case new_id := <-id:
+			return wret.OK(new_id)
+		case err := <-errCh:
+			event_log("log").WithField("file", LogIdFile).Error(err)
+			return wret.IError(err.Error())
+		}
 	})
 
 	rpc.HandleFunc("log/close", func(r wrpc.Req) wrpc.Resp {
@@ -199,7 +280,7 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 		ch <- func() {
 			logs := make([]string, 0, len(weblogs))
 			for id, weblog := range weblogs {
-				if strings.HasPrefix(id, name+"@") {
+				if strings.HasPrefix(id, name+"@") || acl.Allowed(r.Token, id, "read") {
 					logs = append(logs, weblog.Stat(id).Encode())
 				}
 			}
@@ -236,6 +317,10 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 				return
 			}
 
+			start -= weblog.dropped
+			if start < 0 {
+				start = 0
+			}
 			if start < len(weblog.logs) {
 				num := get_num(weblog.logs, max_size)
 				if num < 1 {
@@ -283,8 +368,13 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 		}
 
 		id := r.Args[0]
+		if system_log(id) {
+			return wret.Error("reserved")
+		}
 		ch <- func() {
 			delete(weblogs, id)
+			acl.Drop(id)
+			links.Drop(id)
 			sync.C <- func(sync *wsync.Server) {
 				sync.Boardcast("logs")
 				sync.Boardcast("log:" + id)
@@ -294,7 +384,7 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 		return wret.OK()
 	})
 
-	// log/stat|id ->OK|name|size:int|closed:bool|created:int
+	// log/stat|id ->OK|name|size:int|line:int|closed:bool|created:int|first:int
 	rpc.HandleFunc("log/stat", func(r wrpc.Req) wrpc.Resp {
 		if len(r.Args) != 1 {
 			return wret.Error("args")
@@ -314,40 +404,28 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 		if ret.Id != id {
 			return wret.Error("not_found")
 		}
-		return wret.OK(ret.Name, webasis.Int(ret.Size), webasis.Int(ret.Line), webasis.Bool(ret.Closed), webasis.Int(int(ret.Created.Unix())))
+		return wret.OK(ret.Name, webasis.Int(ret.Size), webasis.Int(ret.Line), webasis.Bool(ret.Closed), webasis.Int(int(ret.Created.Unix())), webasis.Int(ret.First))
 	})
 
-	rpc.HandleFunc("log/append", func(r wrpc.Req) wrpc.Resp {
-		if len(r.Args) < 1 {
-			return wret.Error("args")
-		}
-
-		id := r.Args[0]
-
-		var logs []string
-		if len(r.Args) > 1 {
-			logs = r.Args[1:]
-		}
-
-		reason := ""
-		retOK := make(chan bool, 1)
+	// append_logs returns "" or the reason it failed
+	append_logs := func(id string, logs []string) (reason string) {
+		retReason := make(chan string, 1)
 		ch <- func() {
-			weblog := get_weblog(r.Token, id)
+			weblog := get_weblog(id)
 			if weblog == nil {
-				reason = "not_found"
-				retOK <- false
+				retReason <- "not_found"
 				return
 			}
 
 			if weblog.closed {
-				reason = "closed"
-				retOK <- false
+				retReason <- "closed"
 				return
 			}
 
 			for _, log := range logs {
 				weblog.logs = append(weblog.logs, log)
 			}
+			weblog.trim()
 
 			stat := weblog.Stat(id)
 
@@ -355,22 +433,51 @@ func EnableLog(rpc *wrpc.Server, sync *wsync.Server) {
 				sync.Boardcast("logs")
 				sync.Boardcast("log:"+id, webasis.Int(stat.Line), webasis.Int(int(stat.Created.Unix())))
 			}
-			retOK <- true
+			retReason <- ""
 		}
+		return <-retReason
+	}
 
-		if <-retOK {
-			return wret.OK()
-		} else {
+	rpc.HandleFunc("log/append", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 1 {
+			return wret.Error("args")
+		}
+
+		id := r.Args[0]
+		if system_log(id) {
+			return wret.Error("reserved")
+		}
+
+		if reason := append_logs(id, r.Args[1:]); reason != "" {
 			return wret.Error(reason)
 		}
+		return wret.OK()
 	})
+
+	appendSystem = func(id string, logs ...string) error {
+		if !system_log(id) {
+			return errors.New("not a system log: " + id)
+		}
+		if reason := append_logs(id, logs); reason != "" {
+			return errors.New(reason)
+		}
+		return nil
+	}
+	flush = func() {
+		done := make(chan bool)
+		ch <- func() {
+			close(done)
+		}
+		<-done
+	}
+	return appendSystem, flush
 }
 
 func logs_ls(need_refresh bool) {
 	stats, err := webasis.LogAll(context.TODO())
 	ExitIfErr(err)
 
-	table := clitable.New([]string{"id", "name", "size", "line", "closed", "created"})
+	table := new_output("id", "name", "size", "line", "closed", "created")
 
 	for _, stat := range stats {
 		table.AddRow(map[string]interface{}{
@@ -383,7 +490,7 @@ func logs_ls(need_refresh bool) {
 		})
 	}
 
-	if need_refresh {
+	if need_refresh && OutputFormat == "table" {
 		fmt.Print("\x1B[1;1H\x1B[0J")
 	}
 	table.Print()
@@ -462,7 +569,7 @@ func log() {
 
 		log_append(id, bufsize)
 	case "stats":
-		sync := wsync.NewClient(WSyncServerURL, Token)
+		sync := wsync.NewClient(webasis.WSyncServerURL, webasis.Token)
 		sync.AfterOpen = func(_ *websocket.Conn) {
 			go sync.Sub("log:new", "log:stat", "logs")
 		}
@@ -496,11 +603,22 @@ func log() {
 
 		stat, err := webasis.LogStat(context.TODO(), id)
 		ExitIfErr(err)
-		fmt.Println("Name:", stat.Name)
-		fmt.Println("Size:", stat.Size)
-		fmt.Println("Line:", stat.Line)
-		fmt.Println("Closed:", stat.Closed)
-		fmt.Println("Created:", stat.Created)
+		if OutputFormat == "table" {
+			fmt.Println("Name:", stat.Name)
+			fmt.Println("Size:", stat.Size)
+			fmt.Println("Line:", stat.Line)
+			fmt.Println("Closed:", stat.Closed)
+			fmt.Println("Created:", stat.Created)
+			return
+		}
+		new_output("id", "name", "size", "line", "closed", "created").PrintRow(map[string]interface{}{
+			"id":      stat.Id,
+			"name":    stat.Name,
+			"size":    stat.Size,
+			"line":    stat.Line,
+			"closed":  stat.Closed,
+			"created": stat.Created.Unix(),
+		})
 	case "watch":
 		id := ""
 		if len(os.Args) > 2 {
@@ -511,6 +629,73 @@ func log() {
 			return
 		}
 		watch_log(id)
+	case "share":
+		if len(os.Args) < 5 {
+			log_help()
+			return
+		}
+		ExitIfErr(webasis.LogGrant(context.TODO(), os.Args[2], os.Args[3], os.Args[4]))
+	case "unshare":
+		if len(os.Args) < 4 {
+			log_help()
+			return
+		}
+		ExitIfErr(webasis.LogRevoke(context.TODO(), os.Args[2], os.Args[3]))
+	case "acl":
+		if len(os.Args) < 3 {
+			log_help()
+			return
+		}
+		grants, err := webasis.LogACL(context.TODO(), os.Args[2])
+		ExitIfErr(err)
+
+		table := new_output("grantee", "perm")
+		for _, grant := range grants {
+			table.AddRow(map[string]interface{}{
+				"grantee": grant.Grantee,
+				"perm":    grant.Perm,
+			})
+		}
+		table.Print()
+	case "link":
+		if len(os.Args) < 3 {
+			log_help()
+			return
+		}
+		ttl := ""
+		if len(os.Args) > 3 {
+			ttl = os.Args[3]
+		}
+		_, url, err := webasis.LogLink(context.TODO(), os.Args[2], ttl)
+		ExitIfErr(err)
+		print_value("url", url)
+	case "links":
+		if len(os.Args) < 3 {
+			log_help()
+			return
+		}
+		links, err := webasis.LogLinks(context.TODO(), os.Args[2])
+		ExitIfErr(err)
+
+		table := new_output("id", "created", "expires")
+		for _, link := range links {
+			expires := "never"
+			if !link.Expires.IsZero() {
+				expires = link.Expires.Format("2006-01-02 15:04")
+			}
+			table.AddRow(map[string]interface{}{
+				"id":      link.Id,
+				"created": link.Created.Format("2006-01-02 15:04"),
+				"expires": expires,
+			})
+		}
+		table.Print()
+	case "unlink":
+		if len(os.Args) < 4 {
+			log_help()
+			return
+		}
+		ExitIfErr(webasis.LogUnlink(context.TODO(), os.Args[2], os.Args[3]))
 	case "help":
 		log_help()
 	default:
@@ -519,24 +704,38 @@ func log() {
 }
 
 func watch_log(id string) {
-	sync := wsync.NewClient(WSyncServerURL, Token)
+	needUpdate := make(chan bool, 1)
+	sync := wsync.NewClient(webasis.WSyncServerURL, webasis.Token)
 	sync.AfterOpen = func(_ *websocket.Conn) {
-		go sync.Sub(fmt.Sprintf("log#%s:stat", id))
+		go sync.Sub("log:" + id)
+		// lines appended before or while disconnected
+		select {
+		case needUpdate <- true:
+		default:
+		}
 	}
 
-	needUpdate := make(chan bool, 1)
 	go func() {
+		out := new_output("id", "index", "log")
 		index := 0
 		for range needUpdate {
 			stat, err := webasis.LogStat(context.TODO(), id)
 			ExitIfErr(err)
+			if index < stat.First {
+				// dropped before we got them
+				index = stat.First
+			}
 			logs, err := webasis.LogGet(context.TODO(), id, index, 1000, 1024*10)
 			ExitIfErr(err)
-			index += len(logs)
 
-			for _, line := range logs {
-				fmt.Println(line)
+			for i, line := range logs {
+				if OutputFormat == "table" {
+					fmt.Println(line)
+				} else {
+					out.PrintRow(map[string]interface{}{"id": id, "index": index + i, "log": line})
+				}
 			}
+			index += len(logs)
 
 			if stat.Closed {
 				os.Exit(0)
@@ -560,6 +759,15 @@ func log_get(id string, refresh bool) {
 	logs, err := webasis.LogGet(context.TODO(), id, 0, 1000, 1024*10)
 	ExitIfErr(err)
 
+	if OutputFormat != "table" {
+		out := new_output("id", "index", "log")
+		for i, l := range logs {
+			out.AddRow(map[string]interface{}{"id": id, "index": i, "log": l})
+		}
+		out.Print()
+		return
+	}
+
 	if refresh {
 		fmt.Print("\x1B[1;1H\x1B[0J")
 	}
@@ -588,18 +796,25 @@ func log_append(id string, bufsize int) {
 func ExitIfErr(err error) {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(-1)
+		os.Exit(exitError)
 	}
 }
 
 func log_help() {
 	fmt.Println("help:")
-	fmt.Println("\t", "webasis create [name [bufsize=0]] ")
-	fmt.Println("\t", "webasis append [id [bufsize=0]] ")
-	fmt.Println("\t", "webasis list|ls")
-	fmt.Println("\t", "webasis get id")
-	fmt.Println("\t", "webasis stat id")
-	fmt.Println("\t", "webasis delete|remove|rm id {id}")
-	fmt.Println("\t", "webasis help")
-	os.Exit(-2)
+	fmt.Println("\t", cliName+" create [name [bufsize=0]] ")
+	fmt.Println("\t", cliName+" append [id [bufsize=0]] ")
+	fmt.Println("\t", cliName+" list|ls")
+	fmt.Println("\t", cliName+" get id")
+	fmt.Println("\t", cliName+" stat id")
+	fmt.Println("\t", cliName+" watch id")
+	fmt.Println("\t", cliName+" delete|remove|rm id {id}")
+	fmt.Println("\t", cliName+" share id user:{name}|role:{role} read|append|admin")
+	fmt.Println("\t", cliName+" unshare id user:{name}|role:{role}")
+	fmt.Println("\t", cliName+" acl id")
+	fmt.Println("\t", cliName+" link id [ttl]")
+	fmt.Println("\t", cliName+" links id")
+	fmt.Println("\t", cliName+" unlink id link_id")
+	fmt.Println("\t", cliName+" help")
+	exit_usage()
 }
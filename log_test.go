@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestWeblogTrim(t *testing.T) {
+	wl := new_weblog("audit_log")
+	wl.maxLines = 3
+	for i := 0; i < 10; i++ {
+		wl.logs = append(wl.logs, strconv.Itoa(i))
+		wl.trim()
+	}
+
+	if len(wl.logs) != 3 || wl.logs[0] != "7" || wl.logs[2] != "9" {
+		t.Errorf("logs = %q, want the last 3", wl.logs)
+	}
+	stat := wl.Stat("system@audit")
+	if stat.Line != 10 || stat.First != 7 {
+		t.Errorf("line = %d, first = %d, want 10, 7", stat.Line, stat.First)
+	}
+
+	wl = new_weblog("unlimited")
+	for i := 0; i < 10; i++ {
+		wl.logs = append(wl.logs, strconv.Itoa(i))
+		wl.trim()
+	}
+	if len(wl.logs) != 10 || wl.dropped != 0 {
+		t.Errorf("%d logs, %d dropped, want 10, 0", len(wl.logs), wl.dropped)
+	}
+}
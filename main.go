@@ -4,18 +4,19 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	clitable "github.com/crackcomm/go-clitable"
 	"github.com/gorilla/websocket"
 	"github.com/immofon/mlog"
 	"github.com/webasis/webasis/webasis"
 	"github.com/webasis/wlock"
-	"github.com/webasis/wrbac"
 	"github.com/webasis/wrpc"
 	"github.com/webasis/wrpc/wret"
 	"github.com/webasis/wsync"
@@ -27,85 +28,101 @@ var (
 	SSLCert  = getenv("WEBASIS_SSL_CERT", "")
 	SSLKey   = getenv("WEBASIS_SSL_KEY", "")
 
+	SSLWatchInterval = getenv_duration("WEBASIS_SSL_WATCH_INTERVAL", time.Second*10)
+	SSLMinVersion    = getenv("WEBASIS_SSL_MIN_VERSION", "1.2")      // 1.0|1.1|1.2|1.3
+	SSLCiphers       = getenv("WEBASIS_SSL_CIPHERS", "")             // names separated by ',', empty means go's defaults
+	SSLClientCA      = getenv("WEBASIS_SSL_CLIENT_CA", "")           // enables client certificates
+	SSLClientAuth    = getenv("WEBASIS_SSL_CLIENT_AUTH", "optional") // optional|require
+
 	ServeAddr = getenv("WEBASIS_LISTEN", "localhost:8111")
 
-	AuthFile = getenv("WEBASIS_AUTH_FILE", "")
+	ReadHeaderTimeout = getenv_duration("WEBASIS_READ_HEADER_TIMEOUT", time.Second*10)
+	ReadTimeout       = getenv_duration("WEBASIS_READ_TIMEOUT", time.Minute)
+	WriteTimeout      = getenv_duration("WEBASIS_WRITE_TIMEOUT", time.Minute)
+	IdleTimeout       = getenv_duration("WEBASIS_IDLE_TIMEOUT", time.Minute*2)
+	ShutdownTimeout   = getenv_duration("WEBASIS_SHUTDOWN_TIMEOUT", time.Second*30)
+	ReadyTimeout      = getenv_duration("WEBASIS_READY_TIMEOUT", time.Second*2) // of each check of /readyz
+
+	Modules          = getenv("WEBASIS_MODULES", "log,acl,share,audit,events,notify,schedule,status,metrics,wlock,freetimecollector") // separated by ','
+	MaxContentLength = getenv_int("WEBASIS_MAX_CONTENT_LENGTH", 1024*1024*10)                                                         // of wrpc requests, 10MiB
+
+	AuthFile          = getenv("WEBASIS_AUTH_FILE", "")
+	AuthWatchInterval = getenv_duration("WEBASIS_AUTH_WATCH_INTERVAL", time.Second*2)
+	UserAuditFile     = getenv("WEBASIS_USER_AUDIT_FILE", "user_audit.json.log")
+	AuditFile         = getenv("WEBASIS_AUDIT_FILE", "audit.json.log")
+	ACLFile           = getenv("WEBASIS_ACL_FILE", "acl.json")
+	ShareFile         = getenv("WEBASIS_SHARE_FILE", "shares.json")
+	LogIdFile         = getenv("WEBASIS_LOG_ID_FILE", "log_ids.json")
+	TokenFile         = getenv("WEBASIS_TOKEN_FILE", "tokens.json")
+	ScopedTokenMaxTTL = getenv_duration("WEBASIS_TOKEN_MAX_TTL", time.Hour*24*30)
+	AuditMaxLines     = getenv_int("WEBASIS_AUDIT_MAX_LINES", 10000)                                                                 // kept in system@audit, 0 means unlimited
+	AuditMethods      = getenv("WEBASIS_AUDIT_METHODS", "admin/*,log/delete,log/acl/*,log/link,log/unlink,token/*,notify/prefs/set") // method globs separated by ','
+	AccessLog         = getenv("WEBASIS_ACCESS_LOG", "")                                                                             // file of json lines, - for stdout, empty for none
+	AccessLogSample   = getenv_float("WEBASIS_ACCESS_LOG_SAMPLE", 1)                                                                 // of successful requests, failed ones are all logged
+	AccessLogRedact   = getenv("WEBASIS_ACCESS_LOG_REDACT", "tokens,payloads")                                                       // separated by ','
+	MetricsAuth       = getenv("WEBASIS_METRICS_AUTH", "on")                                                                         // on|off, off serves /metrics to anyone
+	AuthRate          = getenv_int("WEBASIS_AUTH_RATE", 30)                                                                          // unknown tokens verified per minute of a remote, 0 means unlimited
+	AuthBurst         = getenv_int("WEBASIS_AUTH_BURST", 10)
 
 	NotificationURL = getenv("WEBASIS_NOTIFICATION_URL", "http://"+ServeAddr+"/notification")
+	PublicURL       = getenv("WEBASIS_PUBLIC_URL", "http://"+ServeAddr) // base of share links
 
-	// client
-	WSyncServerURL = getenv("WEBASIS_WSYNC_SERVER_URL", "ws://localhost:8111/wsync")
-	WRPCServerURL  = getenv("WEBASIS_WRPC_SERVER_URL", "http://localhost:8111/wrpc")
-	Token          = getenv("WEBASIS_TOKEN", "")
-)
+	// notify
+	NotifyDedupTTL       = getenv_duration("WEBASIS_NOTIFY_DEDUP_TTL", time.Hour)
+	NotifyGroupWindow    = getenv_duration("WEBASIS_NOTIFY_GROUP_WINDOW", time.Minute)
+	NotifySenderRate     = getenv_int("WEBASIS_NOTIFY_SENDER_RATE", 30) // per minute, 0 means unlimited
+	NotifySenderBurst    = getenv_int("WEBASIS_NOTIFY_SENDER_BURST", 10)
+	NotifyRecipientRate  = getenv_int("WEBASIS_NOTIFY_RECIPIENT_RATE", 60) // per minute, 0 means unlimited
+	NotifyRecipientBurst = getenv_int("WEBASIS_NOTIFY_RECIPIENT_BURST", 20)
 
-func getenv(key, defv string) string {
-	v := os.Getenv(key)
-	if v == "" {
-		return defv
-	}
-	return v
-}
+	PrefsFile    = getenv("WEBASIS_PREFS_FILE", "prefs.json")
+	ScheduleFile = getenv("WEBASIS_SCHEDULE_FILE", "schedules.json")
+	MaxSchedules = getenv_int("WEBASIS_MAX_SCHEDULES", 100) // pending jobs per user
+
+	EventsMaxLines = getenv_int("WEBASIS_EVENTS_MAX_LINES", 10000) // kept in system@events, 0 means unlimited
+
+	// client, the webasis package reads the environment only
+	ClientConfigFile = getenv("WEBASIS_CLIENT_CONFIG", webasis.ClientConfigFile)
+	ClientProfile    = getenv("WEBASIS_PROFILE", webasis.ProfileName)
+)
 
 type notifyReq struct {
 	Content string `json:"content"`
-	Token   string `json:"token"`
-}
-
-type Notify struct {
-	Time int64    `json:"time"`
-	Type string   `json:"type"`
-	Data []string `json:"data"`
+	Token   string `json:"token"` // the Authorization header is preferred
 }
 
 func daemon() {
+	if err := config_error(); err != nil {
+		fmt.Printf("\x1b[31m%s\n\x1b[0m", err)
+		os.Exit(1)
+	}
+
 	sync := wsync.NewServer()
+	conns := new_sync_conns()
+	acl := new_log_acl()
+	links := new_share_links()
 	rpc := wrpc.NewServer()
-	rpc.MaxContentLength = 1024 * 1024 * 10 // 10MiB
+	rpc.MaxContentLength = int64(MaxContentLength)
+	observer := new_rpc_observer()
 
 	// open gc
 	go func() {
 		for {
 			time.Sleep(time.Minute * 5)
 			sync.C <- func(sync *wsync.Server) {
+				agents, start := len(sync.Agents), time.Now()
 				sync.GC()
 				// TODO fix: ref to outer resourece
 				// e.g. log:{name}@{id}
+				event_log("wsync").
+					WithField("agents", len(sync.Agents)).
+					WithField("collected", agents-len(sync.Agents)).
+					WithField("took", time.Since(start).String()).
+					Info("gc")
 			}
 		}
 	}()
 
-	rpc.HandleFunc("notify", func(r wrpc.Req) wrpc.Resp {
-		if len(r.Args) != 1 {
-			return wret.Error("args")
-		}
-
-		name, _ := wrbac.FromToken(r.Token)
-
-		content := r.Args[0]
-
-		raw, err := json.Marshal(Notify{
-			Time: time.Now().Unix(),
-			Type: "text",
-			Data: []string{content},
-		})
-		if err != nil {
-			return wret.IError(err.Error())
-		}
-
-		resp := rpc.CallWithoutAuth(wrpc.Req{
-			Token:  r.Token,
-			Method: "log/append",
-			Args:   []string{name + "@notification", string(raw)},
-		})
-		if resp.Status == wrpc.StatusOK {
-			sync.C <- func(sync *wsync.Server) {
-				sync.Boardcast(name+"@notification", content, NotificationURL)
-			}
-		}
-		return resp
-	})
-
 	// adminboardcast|topic{|metas}
 	rpc.HandleFunc("admin/boardcast", func(r wrpc.Req) wrpc.Resp {
 		if len(r.Args) < 1 {
@@ -122,15 +139,63 @@ func daemon() {
 		return wret.OK()
 	})
 
-	EnableAuth(rpc, sync)
-	EnableStatus(rpc, sync)
-	EnableLog(rpc, sync)
+	state, authReady := EnableAuth(rpc, sync, conns, acl)
+	if module_enabled("notify") {
+		EnableNotify(rpc, sync)
+	}
+	if module_enabled("schedule") {
+		EnableSchedule(rpc, sync)
+	}
+	if module_enabled("status") {
+		EnableStatus(rpc, sync, observer)
+	}
+	flushLog := func() {}
+	appendSystem := func(string, ...string) error { return errors.New("log module disabled") }
+	if module_enabled("log") {
+		appendSystem, flushLog = EnableLog(rpc, sync, acl, links)
+	}
+	flushEvents := func() {}
+	if module_enabled("events") {
+		flushEvents = EnableEvents(appendSystem, conns)
+	}
+	if module_enabled("acl") {
+		EnableACL(rpc, acl)
+	}
+	if module_enabled("share") {
+		EnableShare(rpc, links)
+	}
+	if module_enabled("audit") {
+		EnableAudit(rpc, observer, appendSystem)
+	}
+	if module_enabled("metrics") {
+		EnableMetrics(rpc, sync, observer)
+	}
+	if module_enabled("wlock") {
+		lm := wlock.New()
+		wlock.Enable(rpc, lm)
+	}
 
-	lm := wlock.New()
-	wlock.Enable(rpc, lm)
+	checks := []readyCheck{
+		{"auth", authReady},
+		{"wsync", func() error {
+			done := make(chan bool)
+			sync.C <- func(*wsync.Server) {
+				close(done)
+			}
+			<-done
+			return nil
+		}},
+	}
+	if module_enabled("log") {
+		checks = append(checks, readyCheck{"log", func() error {
+			flushLog()
+			return nil
+		}})
+	}
+	EnableHealth(checks)
 
-	http.Handle("/wrpc", rpc)
-	http.Handle("/wsync", sync)
+	http.Handle("/wrpc", wrpc_header_auth(observer.Wrap(rpc, int64(rpc.MaxContentLength)), int64(rpc.MaxContentLength)))
+	http.Handle("/wsync", wsync_header_auth(conns.Wrap(sync)))
 	http.HandleFunc("/api/notify", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -144,6 +209,9 @@ func daemon() {
 			fmt.Fprint(w, err)
 			return
 		}
+		if token := header_token(r); token != "" {
+			req.Token = token
+		}
 
 		ret := rpc.Call(wrpc.Req{
 			Token:  req.Token,
@@ -161,51 +229,135 @@ func daemon() {
 	})
 
 	student_info_ch := make(chan StudentInfo, 200)
+	student_info_flush := make(chan chan bool)
 	go func() {
-		f, err := os.OpenFile("students_info.json.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			mlog.L().Error(err)
-			return
+		var f *os.File
+		if module_enabled("freetimecollector") {
+			var err error
+			f, err = os.OpenFile("students_info.json.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				event_log("freetimecollector").Error(err)
+				f = nil
+			} else {
+				defer f.Close()
+			}
 		}
-		defer f.Close()
 
-		out := json.NewEncoder(f)
-		for info := range student_info_ch {
-			out.Encode(info)
-			f.Sync()
+		write := func(info StudentInfo) {
+			if f != nil {
+				json.NewEncoder(f).Encode(info)
+				f.Sync()
+			}
+		}
+		for {
+			select {
+			case info := <-student_info_ch:
+				write(info)
+			case done := <-student_info_flush:
+				for len(student_info_ch) > 0 {
+					write(<-student_info_ch)
+				}
+				close(done)
+			}
 		}
 	}()
 
-	http.HandleFunc("/api/freetimecollector", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+	if module_enabled("freetimecollector") {
+		http.HandleFunc("/api/freetimecollector", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			var info StudentInfo
+			err := json.NewDecoder(r.Body).Decode(&info)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if info.Time == 0 {
+				info.Time = int(time.Now().Unix())
+			}
+
+			// write info
+			student_info_ch <- info
 
-		var info StudentInfo
-		err := json.NewDecoder(r.Body).Decode(&info)
+			w.WriteHeader(http.StatusOK)
+		})
+	}
+
+	handler := new_auth_limiter().Wrap(http.DefaultServeMux, state)
+	if AccessLog != "" {
+		access, err := new_access_log()
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		if info.Time == 0 {
-			info.Time = int(time.Now().Unix())
+			fmt.Printf("\x1b[31m%s\n\x1b[0m", err)
+			os.Exit(1)
 		}
+		observer.Add(access.ObserveRPC)
+		handler = access.Wrap(handler)
+	}
 
-		// write info
-		student_info_ch <- info
+	srv := &http.Server{
+		Addr:              ServeAddr,
+		Handler:           cert_auth(handler, state),
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+	}
 
-		w.WriteHeader(http.StatusOK)
-	})
+	served := make(chan error, 1)
+	go func() {
+		event_log("daemon").
+			WithField("addr", ServeAddr).
+			WithField("version", Version).
+			WithField("modules", Modules).
+			Info("listen")
+		if ServeSSL == "on" {
+			event_log("daemon").Info("open ssl")
+			tlsConfig, err := new_tls_config()
+			if err != nil {
+				served <- err
+				return
+			}
+			srv.TLSConfig = tlsConfig
+			served <- srv.ListenAndServeTLS("", "")
+		} else {
+			served <- srv.ListenAndServe()
+		}
+	}()
 
-	mlog.L().WithField("addr", ServeAddr).Info("listen")
-	if ServeSSL == "on" {
-		mlog.L().Info("open ssl")
-		mlog.L().Error(http.ListenAndServeTLS(ServeAddr, SSLCert, SSLKey, nil))
-	} else {
-		mlog.L().Error(http.ListenAndServe(ServeAddr, nil))
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-served:
+		event_log("daemon").Error(err)
+		flushEvents()
+		os.Exit(1)
+	case sig := <-stop:
+		event_log("daemon").WithField("signal", sig.String()).Info("shutdown")
+	}
+
+	// stop accepting, wait for running requests, then close agents and
+	// flush what they left
+	status := 0
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	if err := srv.Shutdown(ctx); err != nil {
+		event_log("daemon").Error("shutdown: ", err)
+		srv.Close()
+		status = 1
 	}
+	cancel()
+	closed := conns.CloseAll()
+	done := make(chan bool)
+	student_info_flush <- done
+	<-done
+
+	event_log("daemon").WithField("disconnected", closed).WithField("status", status).Info("shutdown done")
+	flushEvents()
+	flushLog()
+	os.Exit(status)
 }
 
 type FreeTime struct {
@@ -224,29 +376,13 @@ type StudentInfo struct {
 
 func main() {
 	mlog.TextMode()
-	cmd := getenv("cmd", "rpc")
-	switch cmd {
-	case "daemon":
-		daemon()
-	case "check":
-		wrbac_check()
-	case "push":
-		push()
-	case "client":
-		client()
-	case "watch":
-		watch()
-	case "rpc":
-		rpc()
-	case "log":
-		log()
-	}
+	os.Exit(cli(os.Args))
 }
 
 func rpc() {
 	if len(os.Args) < 2 {
-		fmt.Println("webasis method {args}")
-		return
+		fmt.Println(cliName + " method {args}")
+		exit_usage()
 	}
 
 	method := os.Args[1]
@@ -258,22 +394,36 @@ func rpc() {
 	resp, err := webasis.Call(context.TODO(), method, args...)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(-1)
+		os.Exit(exitError)
 	}
 
-	if resp.Status == wrpc.StatusOK {
+	status := exitOK
+	if resp.Status != wrpc.StatusOK {
+		status = exitError
+	}
+
+	switch OutputFormat {
+	case "json", "ndjson":
+		new_output("status", "rets").PrintRow(map[string]interface{}{"status": resp.Status, "rets": resp.Rets})
+	case "tsv":
+		out := new_output("status", "ret")
 		for _, ret := range resp.Rets {
-			fmt.Println(ret)
+			out.PrintRow(map[string]interface{}{"status": resp.Status, "ret": ret})
+		}
+	default:
+		if resp.Status == wrpc.StatusOK {
+			for _, ret := range resp.Rets {
+				fmt.Println(ret)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "\x1b[31m%s \x1b[33m%s\x1b[0m\n", resp.Status, strings.Join(resp.Rets, "\x1b[90m|\x1b[33m"))
 		}
-		os.Exit(0)
-	} else {
-		fmt.Fprintf(os.Stderr, "\x1b[31m%s \x1b[33m%s\x1b[0m\n", resp.Status, strings.Join(resp.Rets, "\x1b[90m|\x1b[33m"))
-		os.Exit(1)
 	}
+	os.Exit(status)
 }
 
 func client() {
-	sync := wsync.NewClient(WSyncServerURL, Token)
+	sync := wsync.NewClient(webasis.WSyncServerURL, webasis.Token)
 	sync.OnTopic = func(topic string, metas ...string) {
 		fmt.Println("t:", topic, metas)
 	}
@@ -326,75 +476,7 @@ func push() {
 	err := webasis.ShareFile(context.TODO(), name, os.Stdin)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(-1)
-	}
-}
-
-func watch() {
-	connected := ""
-	messageSent := ""
-	rpcCount := ""
-	ch := make(chan func(), 1)
-
-	show := func() {
-		fmt.Print("\x1B[1;1H\x1B[0J")
-		table := clitable.New([]string{"key", "value"})
-
-		table.AddRow(map[string]interface{}{"key": "count/wsync/connect", "value": connected})
-		table.AddRow(map[string]interface{}{"key": "count/wsync/message", "value": messageSent})
-		table.AddRow(map[string]interface{}{"key": "count/rpc/called", "value": rpcCount})
-
-		table.Print()
-	}
-	go func() {
-		for {
-			time.Sleep(time.Second)
-			resp, err := webasis.Call(context.TODO(), "status/wsync/connected")
-			if err != nil {
-				continue
-			}
-
-			if resp.Status == wrpc.StatusOK {
-				ch <- func() {
-					connected = resp.Rets[0]
-				}
-			}
-		}
-	}()
-	go func() {
-		for {
-			time.Sleep(time.Second)
-			resp, err := webasis.Call(context.TODO(), "status/wsync/message")
-			if err != nil {
-				continue
-			}
-
-			if resp.Status == wrpc.StatusOK {
-				ch <- func() {
-					messageSent = resp.Rets[0]
-				}
-			}
-		}
-	}()
-	go func() {
-		for {
-			time.Sleep(time.Second)
-			resp, err := webasis.Call(context.TODO(), "status/wrpc/called")
-			if err != nil {
-				continue
-			}
-
-			if resp.Status == wrpc.StatusOK {
-				ch <- func() {
-					rpcCount = resp.Rets[0]
-				}
-			}
-		}
-	}()
-
-	for fn := range ch {
-		fn()
-		show()
+		os.Exit(exitError)
 	}
 }
 
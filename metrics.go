@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+	"github.com/webasis/wsync"
+)
+
+// upper bounds of rpc latency buckets, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// methods beyond it are counted as "other", clients choose method names
+const maxMetricMethods = 500
+
+type histogram struct {
+	counts []uint64 // of latencyBuckets
+	sum    float64
+	count  uint64
+}
+
+// rpcMetrics counts calls served on /wrpc, see rpcObserver
+type rpcMetrics struct {
+	lock    sync.Mutex
+	calls   map[[2]string]uint64 // map[{method, status}]count
+	latency map[string]*histogram
+}
+
+func new_rpc_metrics() *rpcMetrics {
+	return &rpcMetrics{
+		calls:   make(map[[2]string]uint64),
+		latency: make(map[string]*histogram),
+	}
+}
+
+func (m *rpcMetrics) Observe(call rpcCall) {
+	method, status := call.Req.Method, string(call.Status)
+	if status == "" {
+		status = "unknown"
+	}
+	seconds := call.Latency.Seconds()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	h, ok := m.latency[method]
+	if !ok {
+		if len(m.latency) >= maxMetricMethods {
+			method = "other"
+			h = m.latency[method]
+		}
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+			m.latency[method] = h
+		}
+	}
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+	m.calls[[2]string{method, status}]++
+}
+
+// metricsWriter writes the prometheus text format
+type metricsWriter struct {
+	strings.Builder
+}
+
+func metric_label_escape(v string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(v)
+}
+
+func (w *metricsWriter) Head(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Value writes name{labels} value, labels are pairs of name and value
+func (w *metricsWriter) Value(name string, v float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"=\""+metric_label_escape(labels[i+1])+"\"")
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+func (m *rpcMetrics) write(w *metricsWriter) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([][2]string, 0, len(m.calls))
+	for key := range m.calls {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	w.Head("webasis_wrpc_requests_total", "counter", "Calls served on /wrpc by method and status.")
+	for _, key := range keys {
+		w.Value("webasis_wrpc_requests_total", float64(m.calls[key]), "method", key[0], "status", key[1])
+	}
+
+	methods := make([]string, 0, len(m.latency))
+	for method := range m.latency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	w.Head("webasis_wrpc_request_duration_seconds", "histogram", "Latency of calls served on /wrpc by method.")
+	for _, method := range methods {
+		h := m.latency[method]
+		for i, le := range latencyBuckets {
+			w.Value("webasis_wrpc_request_duration_seconds_bucket", float64(h.counts[i]), "method", method, "le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		w.Value("webasis_wrpc_request_duration_seconds_bucket", float64(h.count), "method", method, "le", "+Inf")
+		w.Value("webasis_wrpc_request_duration_seconds_sum", h.sum, "method", method)
+		w.Value("webasis_wrpc_request_duration_seconds_count", float64(h.count), "method", method)
+	}
+}
+
+// admin/metrics -> OK|text	prometheus text format
+//
+// GET /metrics serves the same text. It needs a token, in the Authorization
+// header, allowed to call admin/metrics unless $WEBASIS_METRICS_AUTH is off.
+func EnableMetrics(rpc *wrpc.Server, sync *wsync.Server, observer *rpcObserver) {
+	started := time.Now()
+	calls := new_rpc_metrics()
+	observer.Add(calls.Observe)
+
+	rpc.HandleFunc("admin/metrics", func(r wrpc.Req) wrpc.Resp {
+		w := &metricsWriter{}
+
+		// wsync, skipped if its loop is busy
+		type syncStat struct{ agents, sent, initMetas int }
+		ret := make(chan syncStat, 1)
+		timeout := time.After(time.Second)
+		select {
+		case sync.C <- func(sync *wsync.Server) {
+			ret <- syncStat{len(sync.Agents), sync.MessageSent, len(sync.InitMetas)}
+		}:
+			select {
+			case s := <-ret:
+				w.Head("webasis_wsync_agents", "gauge", "Connected wsync agents.")
+				w.Value("webasis_wsync_agents", float64(s.agents))
+				w.Head("webasis_wsync_messages_sent_total", "counter", "Messages sent to wsync agents.")
+				w.Value("webasis_wsync_messages_sent_total", float64(s.sent))
+				w.Head("webasis_wsync_init_metas", "gauge", "Size of wsync InitMetas.")
+				w.Value("webasis_wsync_init_metas", float64(s.initMetas))
+			case <-timeout:
+			}
+		case <-timeout:
+		}
+
+		calls.write(w)
+		w.Head("webasis_wrpc_called_total", "counter", "Calls of wrpc, including the daemon's own ones.")
+		w.Value("webasis_wrpc_called_total", float64(rpc.Status().Count))
+
+		// weblogs by owner
+		if resp := rpc.CallWithoutAuth(wrpc.Req{Method: "admin/log/all"}); resp.Status == wrpc.StatusOK {
+			type logStat struct{ logs, bytes, lines int }
+			users := make(map[string]*logStat)
+			for _, raw := range resp.Rets {
+				stat := webasis.DecodeWebLogStat(raw)
+				user := strings.SplitN(stat.Id, "@", 2)[0]
+				if users[user] == nil {
+					users[user] = &logStat{}
+				}
+				users[user].logs++
+				users[user].bytes += stat.Size
+				users[user].lines += stat.Line
+			}
+			names := make([]string, 0, len(users))
+			for name := range users {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			w.Head("webasis_weblogs", "gauge", "Weblogs by owner.")
+			for _, name := range names {
+				w.Value("webasis_weblogs", float64(users[name].logs), "user", name)
+			}
+			w.Head("webasis_weblog_bytes", "gauge", "Bytes of weblogs by owner.")
+			for _, name := range names {
+				w.Value("webasis_weblog_bytes", float64(users[name].bytes), "user", name)
+			}
+			w.Head("webasis_weblog_lines", "gauge", "Lines of weblogs by owner.")
+			for _, name := range names {
+				w.Value("webasis_weblog_lines", float64(users[name].lines), "user", name)
+			}
+		}
+
+		if resp := rpc.CallWithoutAuth(wrpc.Req{Method: "admin/status/notify/delivered"}); resp.Status == wrpc.StatusOK {
+			fields := webasis.Fields(resp.Rets)
+			w.Head("webasis_notifications_delivered_total", "counter", "Notifications appended to their receiver's log.")
+			w.Value("webasis_notifications_delivered_total", float64(fields.Int(0, 0)))
+			w.Head("webasis_notifications_failed_total", "counter", "Notifications failed to be appended.")
+			w.Value("webasis_notifications_failed_total", float64(fields.Int(1, 0)))
+		}
+		if resp := rpc.CallWithoutAuth(wrpc.Req{Method: "admin/status/notify/suppressed"}); resp.Status == wrpc.StatusOK {
+			fields := webasis.Fields(resp.Rets)
+			w.Head("webasis_notifications_suppressed_total", "counter", "Notifications not delivered at once by reason.")
+			for i, reason := range []string{"dedup", "grouped", "sender_limited", "recipient_limited", "muted", "quiet"} {
+				w.Value("webasis_notifications_suppressed_total", float64(fields.Int(i, 0)), "reason", reason)
+			}
+		}
+
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		w.Head("webasis_start_time_seconds", "gauge", "Start time of the daemon since unix epoch.")
+		w.Value("webasis_start_time_seconds", float64(started.Unix()))
+		w.Head("go_goroutines", "gauge", "Number of goroutines.")
+		w.Value("go_goroutines", float64(runtime.NumGoroutine()))
+		w.Head("go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+		w.Value("go_memstats_alloc_bytes", float64(mem.Alloc))
+		w.Head("go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.")
+		w.Value("go_memstats_sys_bytes", float64(mem.Sys))
+		w.Head("go_memstats_heap_objects", "gauge", "Number of allocated heap objects.")
+		w.Value("go_memstats_heap_objects", float64(mem.HeapObjects))
+		w.Head("go_gc_cycles_total", "counter", "Completed GC cycles.")
+		w.Value("go_gc_cycles_total", float64(mem.NumGC))
+		w.Head("go_gc_pause_seconds_total", "counter", "Total GC pause time.")
+		w.Value("go_gc_pause_seconds_total", float64(mem.PauseTotalNs)/1e9)
+
+		return wret.OK(w.String())
+	})
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := wrpc.Req{Token: header_token(r), Method: "admin/metrics"}
+		var resp wrpc.Resp
+		if MetricsAuth == "off" {
+			resp = rpc.CallWithoutAuth(req)
+		} else {
+			resp = rpc.Call(req)
+		}
+		switch {
+		case resp.Status == wrpc.StatusAuth:
+			w.WriteHeader(http.StatusUnauthorized)
+		case resp.Status != wrpc.StatusOK || len(resp.Rets) != 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.Write([]byte(resp.Rets[0]))
+		}
+	})
+}
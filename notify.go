@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+	"github.com/webasis/wsync"
+)
+
+type Notify struct {
+	Time  int64    `json:"time"`
+	Type  string   `json:"type"`
+	Data  []string `json:"data"`
+	Key   string   `json:"key,omitempty"`
+	Count int      `json:"count,omitempty"` // repeats collapsed into this entry
+
+	Priority int      `json:"priority,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Sender   string   `json:"sender,omitempty"` // name of the caller's token, never an arg
+
+	token string // of the sender, for deliveries after the call, not saved
+}
+
+// token bucket, refilled with rate tokens per minute
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bucket) take(now time.Time, rate, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Minutes() * float64(rate)
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type notifyGroup struct {
+	first Notify // with the token of its sender
+	count int    // repeats since the first one was delivered
+}
+
+type notifySuppressed struct {
+	Dedup            int
+	Grouped          int
+	SenderLimited    int
+	RecipientLimited int
+	Muted            int // muted sender/tag or below min priority
+	Quiet            int // held or dropped in quiet hours
+}
+
+// notify|content[|key[|priority[|tags]]] -> OK	WSYNC: {name}@notification|content|url[|count]
+// notify/prefs -> OK|json
+// notify/prefs/set|json -> OK
+// admin/status/notify/suppressed -> OK|dedup|grouped|sender_limited|recipient_limited|muted|quiet
+// admin/status/notify/delivered -> OK|delivered|failed
+//
+// A notification with a key is dropped if the same key was delivered to the
+// same user within $WEBASIS_NOTIFY_DEDUP_TTL. Repeats of the same content
+// within $WEBASIS_NOTIFY_GROUP_WINDOW are collapsed into one entry with a
+// counter, delivered when the window ends.
+//
+// Notifications arriving in the user's quiet hours are held, digested or
+// dropped as the user prefers; held ones are delivered when quiet hours end.
+// tags are separated by ','.
+func EnableNotify(rpc *wrpc.Server, sync *wsync.Server) {
+	dedup := make(map[string]time.Time)     // map[name@key]delivered
+	groups := make(map[string]*notifyGroup) // map[name@content]group
+	senders := make(map[string]*bucket)     // map[token]bucket
+	recipients := make(map[string]*bucket)  // map[name]bucket
+	suppressed := notifySuppressed{}
+	var delivered, failed int64 // atomic, deliver runs in and out of ch
+	prefs := load_prefs()
+
+	ch := make(chan func(), 1000)
+	go func() {
+		for fn := range ch {
+			fn()
+		}
+	}()
+
+	deliver := func(token, name string, n Notify) wrpc.Resp {
+		raw, err := json.Marshal(n)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+
+		resp := rpc.CallWithoutAuth(wrpc.Req{
+			Token:  token,
+			Method: "log/append",
+			Args:   []string{name + "@notification", string(raw)},
+		})
+		if resp.Status != wrpc.StatusOK {
+			atomic.AddInt64(&failed, 1)
+		} else {
+			atomic.AddInt64(&delivered, 1)
+			content := n.Data[0]
+			if n.Type == "digest" {
+				content = fmt.Sprintf("%d notifications in quiet hours", len(n.Data))
+			}
+			metas := []string{content, NotificationURL}
+			if n.Count > 0 {
+				metas = append(metas, webasis.Int(n.Count))
+			}
+			sync.C <- func(sync *wsync.Server) {
+				sync.Boardcast(name+"@notification", metas...)
+			}
+		}
+		return resp
+	}
+
+	// held notifications passed the rate limits when they arrived
+	release := func(name, mode string, held []Notify) {
+		if mode == "hold" {
+			for _, n := range held {
+				deliver(n.token, name, n)
+			}
+			return
+		}
+
+		digest := Notify{
+			Time: time.Now().Unix(),
+			Type: "digest",
+			Data: make([]string, 0, len(held)),
+		}
+		for _, n := range held {
+			digest.Data = append(digest.Data, n.Data[0])
+		}
+		// of many senders, the daemon's own
+		deliver("", name, digest)
+	}
+
+	// sweep expired dedup keys and idle buckets, release notifications held in quiet hours
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			ch <- func() {
+				now := time.Now()
+				for k, t := range dedup {
+					if now.Sub(t) > NotifyDedupTTL {
+						delete(dedup, k)
+					}
+				}
+				for k, b := range senders {
+					if now.Sub(b.last) > time.Hour {
+						delete(senders, k)
+					}
+				}
+				for k, b := range recipients {
+					if now.Sub(b.last) > time.Hour {
+						delete(recipients, k)
+					}
+				}
+				for name, held := range prefs.Held {
+					p := prefs.Get(name)
+					if p.Quiet(now) {
+						continue
+					}
+					delete(prefs.Held, name)
+					prefs.Save()
+					go release(name, p.Mode(), held)
+				}
+			}
+		}
+	}()
+
+	// quiet returns "" if the notification should be delivered now
+	quiet := func(name string, n Notify, now time.Time) (reason string) {
+		p := prefs.Get(name)
+		if n.Priority >= NotifyUrgentPriority || !p.Quiet(now) {
+			return ""
+		}
+
+		suppressed.Quiet++
+		if p.Mode() == "drop" {
+			return "quiet"
+		}
+		prefs.Held[name] = append(prefs.Held[name], n)
+		prefs.Save()
+		return "held"
+	}
+
+	// take_sender takes a token of the sender's bucket
+	take_sender := func(token string, now time.Time) bool {
+		sender := senders[token]
+		if sender == nil {
+			sender = &bucket{}
+			senders[token] = sender
+		}
+		if !sender.take(now, NotifySenderRate, NotifySenderBurst) {
+			suppressed.SenderLimited++
+			return false
+		}
+		return true
+	}
+
+	// flush delivers the repeats of a group as one more notification of its
+	// sender
+	flush := func(name, groupKey string) {
+		group := groups[groupKey]
+		delete(groups, groupKey)
+		if group == nil || group.count == 0 {
+			return
+		}
+
+		now := time.Now()
+		n := group.first
+		n.Time = now.Unix()
+		n.Count = group.count
+		if !take_sender(n.token, now) {
+			return
+		}
+		if quiet(name, n, now) != "" {
+			return
+		}
+		go deliver(n.token, name, n)
+	}
+
+	// filter returns "" if the notification should be delivered now
+	filter := func(token, name string, n Notify, now time.Time) (reason string) {
+		p := prefs.Get(name)
+		if p.Muted(n) || n.Priority < p.MinPriority {
+			suppressed.Muted++
+			return "muted"
+		}
+
+		if n.Key != "" {
+			if t, ok := dedup[name+"@"+n.Key]; ok && now.Sub(t) <= NotifyDedupTTL {
+				suppressed.Dedup++
+				return "dedup"
+			}
+		}
+
+		groupKey := name + "@" + n.Data[0]
+		if group, ok := groups[groupKey]; ok {
+			group.count++
+			suppressed.Grouped++
+			return "grouped"
+		}
+
+		if !take_sender(token, now) {
+			return "rate_limited"
+		}
+
+		recipient := recipients[name]
+		if recipient == nil {
+			recipient = &bucket{}
+			recipients[name] = recipient
+		}
+		if !recipient.take(now, NotifyRecipientRate, NotifyRecipientBurst) {
+			suppressed.RecipientLimited++
+			return "rate_limited"
+		}
+
+		if n.Key != "" {
+			dedup[name+"@"+n.Key] = now
+		}
+		// held ones don't open a group
+		if reason := quiet(name, n, now); reason != "" {
+			return reason
+		}
+		if NotifyGroupWindow > 0 {
+			groups[groupKey] = &notifyGroup{first: n}
+			time.AfterFunc(NotifyGroupWindow, func() {
+				ch <- func() {
+					flush(name, groupKey)
+				}
+			})
+		}
+		return ""
+	}
+
+	rpc.HandleFunc("notify", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 1 || len(r.Args) > 4 {
+			return wret.Error("args")
+		}
+
+		name, _ := wrbac.FromToken(r.Token)
+
+		fields := webasis.Fields(r.Args)
+		now := time.Now()
+		n := Notify{
+			Time:     now.Unix(),
+			Type:     "text",
+			Data:     []string{fields.Get(0, "")},
+			Key:      fields.Get(1, ""),
+			Priority: fields.Int(2, 0),
+			Sender:   name,
+			token:    r.Token,
+		}
+		if tags := fields.Get(3, ""); tags != "" {
+			n.Tags = strings.Split(tags, ",")
+		}
+
+		reasonCh := make(chan string, 1)
+		ch <- func() {
+			reasonCh <- filter(r.Token, name, n, now)
+		}
+		switch <-reasonCh {
+		case "":
+		case "rate_limited":
+			return wret.Error("rate_limited")
+		default:
+			return wret.OK()
+		}
+
+		return deliver(r.Token, name, n)
+	})
+
+	rpc.HandleFunc("notify/prefs", func(r wrpc.Req) wrpc.Resp {
+		name, _ := wrbac.FromToken(r.Token)
+
+		ret := make(chan notifyPrefs, 1)
+		ch <- func() {
+			ret <- *prefs.Get(name)
+		}
+		raw, err := json.Marshal(<-ret)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+		return wret.OK(string(raw))
+	})
+
+	rpc.HandleFunc("notify/prefs/set", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+
+		name, _ := wrbac.FromToken(r.Token)
+
+		p := &notifyPrefs{}
+		if err := json.Unmarshal([]byte(r.Args[0]), p); err != nil {
+			return wret.Error("args", err.Error())
+		}
+		if err := p.Validate(); err != nil {
+			return wret.Error("args", err.Error())
+		}
+
+		done := make(chan bool, 1)
+		ch <- func() {
+			prefs.Prefs[name] = p
+			prefs.Save()
+			done <- true
+		}
+		<-done
+		return wret.OK()
+	})
+
+	rpc.HandleFunc("admin/status/notify/suppressed", func(r wrpc.Req) wrpc.Resp {
+		ret := make(chan notifySuppressed, 1)
+		ch <- func() {
+			ret <- suppressed
+		}
+		s := <-ret
+		return wret.OK(fmt.Sprint(s.Dedup), fmt.Sprint(s.Grouped), fmt.Sprint(s.SenderLimited), fmt.Sprint(s.RecipientLimited), fmt.Sprint(s.Muted), fmt.Sprint(s.Quiet))
+	})
+
+	rpc.HandleFunc("admin/status/notify/delivered", func(r wrpc.Req) wrpc.Resp {
+		return wret.OK(fmt.Sprint(atomic.LoadInt64(&delivered)), fmt.Sprint(atomic.LoadInt64(&failed)))
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	clitable "github.com/crackcomm/go-clitable"
+)
+
+// OutputFormat of commands, set by --output
+var OutputFormat = "table"
+
+var outputFormats = map[string]bool{
+	"table":  true,
+	"json":   true, // an array of objects, or an object per line for streams
+	"ndjson": true,
+	"tsv":    true,
+}
+
+// output prints rows of cols in OutputFormat. Keys of json objects and the
+// tsv header are the cols.
+type output struct {
+	cols []string
+	rows []map[string]interface{}
+}
+
+func new_output(cols ...string) *output {
+	return &output{cols: cols, rows: make([]map[string]interface{}, 0)}
+}
+
+func (o *output) AddRow(row map[string]interface{}) {
+	o.rows = append(o.rows, row)
+}
+
+func tsv_escape(v interface{}) string {
+	return strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r").Replace(fmt.Sprint(v))
+}
+
+func (o *output) tsv_row(row map[string]interface{}) string {
+	values := make([]string, len(o.cols))
+	for i, col := range o.cols {
+		if v, ok := row[col]; ok {
+			values[i] = tsv_escape(v)
+		}
+	}
+	return strings.Join(values, "\t")
+}
+
+func (o *output) object(row map[string]interface{}) map[string]interface{} {
+	obj := make(map[string]interface{}, len(o.cols))
+	for _, col := range o.cols {
+		obj[col] = row[col]
+	}
+	return obj
+}
+
+func (o *output) Print() {
+	switch OutputFormat {
+	case "json":
+		objs := make([]map[string]interface{}, len(o.rows))
+		for i, row := range o.rows {
+			objs[i] = o.object(row)
+		}
+		json.NewEncoder(os.Stdout).Encode(objs)
+	case "ndjson":
+		out := json.NewEncoder(os.Stdout)
+		for _, row := range o.rows {
+			out.Encode(o.object(row))
+		}
+	case "tsv":
+		fmt.Println(strings.Join(o.cols, "\t"))
+		for _, row := range o.rows {
+			fmt.Println(o.tsv_row(row))
+		}
+	default:
+		table := clitable.New(o.cols)
+		for _, row := range o.rows {
+			table.AddRow(row)
+		}
+		table.Print()
+	}
+}
+
+// PrintRow prints row alone, for streams: an object per line for json and
+// ndjson, a header before the first row for tsv. The table format is left
+// to the caller.
+func (o *output) PrintRow(row map[string]interface{}) {
+	switch OutputFormat {
+	case "json", "ndjson":
+		json.NewEncoder(os.Stdout).Encode(o.object(row))
+	case "tsv":
+		if len(o.rows) == 0 {
+			fmt.Println(strings.Join(o.cols, "\t"))
+			o.rows = append(o.rows, nil)
+		}
+		fmt.Println(o.tsv_row(row))
+	}
+}
+
+// print_value prints a single result, an object for json, as it is for the
+// table format
+func print_value(key string, value interface{}) {
+	if OutputFormat == "table" {
+		fmt.Println(value)
+		return
+	}
+	new_output(key).PrintRow(map[string]interface{}{key: value})
+}
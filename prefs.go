@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// notifications with priority >= NotifyUrgentPriority ignore quiet hours
+const NotifyUrgentPriority = 2
+
+type notifyPrefs struct {
+	QuietStart   string   `json:"quiet_start"` // 15:04, empty means no quiet hours
+	QuietEnd     string   `json:"quiet_end"`   // 15:04
+	Timezone     string   `json:"timezone"`    // e.g. Asia/Shanghai, empty means server local time
+	QuietMode    string   `json:"quiet_mode"`  // hold|digest|drop, default digest
+	MinPriority  int      `json:"min_priority"`
+	MutedSenders []string `json:"muted_senders"`
+	MutedTags    []string `json:"muted_tags"`
+}
+
+func parse_clock(v string) (minute int, err error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (p *notifyPrefs) Validate() error {
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		return errors.New("quiet_start and quiet_end must be set together")
+	}
+	if p.QuietStart != "" {
+		if _, err := parse_clock(p.QuietStart); err != nil {
+			return errors.New("bad quiet_start: " + p.QuietStart)
+		}
+		if _, err := parse_clock(p.QuietEnd); err != nil {
+			return errors.New("bad quiet_end: " + p.QuietEnd)
+		}
+	}
+	if _, err := time.LoadLocation(p.Timezone); err != nil {
+		return errors.New("bad timezone: " + p.Timezone)
+	}
+	switch p.QuietMode {
+	case "", "hold", "digest", "drop":
+	default:
+		return errors.New("bad quiet_mode: " + p.QuietMode)
+	}
+	return nil
+}
+
+func (p *notifyPrefs) Mode() string {
+	if p.QuietMode == "" {
+		return "digest"
+	}
+	return p.QuietMode
+}
+
+func (p *notifyPrefs) Quiet(now time.Time) bool {
+	if p.QuietStart == "" {
+		return false
+	}
+	start, err1 := parse_clock(p.QuietStart)
+	end, err2 := parse_clock(p.QuietEnd)
+	loc, err3 := time.LoadLocation(p.Timezone)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return false
+	}
+
+	now = now.In(loc)
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return start <= minute && minute < end
+	}
+	// across midnight, e.g. 22:00-08:00
+	return minute >= start || minute < end
+}
+
+func (p *notifyPrefs) Muted(n Notify) bool {
+	for _, sender := range p.MutedSenders {
+		if sender == n.Sender {
+			return true
+		}
+	}
+	for _, muted := range p.MutedTags {
+		for _, tag := range n.Tags {
+			if muted == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type notifyPrefsStore struct {
+	Prefs map[string]*notifyPrefs `json:"prefs"` // map[name]prefs
+	Held  map[string][]Notify     `json:"held"`  // map[name]notifications held in quiet hours
+}
+
+func load_prefs() notifyPrefsStore {
+	store := notifyPrefsStore{}
+	raw, err := ioutil.ReadFile(PrefsFile)
+	if err != nil && !os.IsNotExist(err) {
+		event_log("notify").Error(err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(raw, &store); err != nil {
+			event_log("notify").Error(err)
+		}
+	}
+	if store.Prefs == nil {
+		store.Prefs = make(map[string]*notifyPrefs)
+	}
+	if store.Held == nil {
+		store.Held = make(map[string][]Notify)
+	}
+	return store
+}
+
+func (store notifyPrefsStore) Save() {
+	raw, err := json.MarshalIndent(store, "", "\t")
+	if err == nil {
+		err = write_file_atomic(PrefsFile, raw, 0600)
+	}
+	if err != nil {
+		event_log("notify").WithField("file", PrefsFile).Error(err)
+	}
+}
+
+func (store notifyPrefsStore) Get(name string) *notifyPrefs {
+	if p, ok := store.Prefs[name]; ok {
+		return p
+	}
+	return &notifyPrefs{}
+}
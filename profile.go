@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/webasis/webasis/webasis"
+)
+
+func profile() {
+	cmd := "help"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	switch cmd {
+	case "list", "ls":
+		cfg, err := webasis.LoadClientConfig()
+		ExitIfErr(err)
+
+		table := new_output("using", "name", "wrpc", "wsync")
+		for _, name := range cfg.ProfileNames() {
+			p := cfg.Profiles[name]
+			using := ""
+			if name == webasis.ProfileName {
+				using = "*"
+			}
+			table.AddRow(map[string]interface{}{
+				"using": using,
+				"name":  name,
+				"wrpc":  p.WRPCServerURL,
+				"wsync": p.WSyncServerURL,
+			})
+		}
+		table.Print()
+	case "show":
+		if OutputFormat == "table" {
+			fmt.Println("profile:", webasis.ProfileName)
+			fmt.Println("file:", webasis.ClientConfigFile)
+			fmt.Println("wrpc:", webasis.WRPCServerURL)
+			fmt.Println("wsync:", webasis.WSyncServerURL)
+			return
+		}
+		new_output("profile", "file", "wrpc", "wsync").PrintRow(map[string]interface{}{
+			"profile": webasis.ProfileName,
+			"file":    webasis.ClientConfigFile,
+			"wrpc":    webasis.WRPCServerURL,
+			"wsync":   webasis.WSyncServerURL,
+		})
+	default:
+		profile_help()
+	}
+}
+
+func profile_help() {
+	fmt.Println("help:")
+	fmt.Println("\t", cliName+" list|ls")
+	fmt.Println("\t", cliName+" show")
+	exit_usage()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wsync"
+)
+
+// RoleDef is a role of the auth file. The first rule matching a call decides
+// it, a call matching no rule is denied. {name} in arg_prefix and topics is
+// the caller's name.
+type RoleDef struct {
+	RPC  []RPCRule  `json:"rpc"`
+	Sync []SyncRule `json:"sync"`
+}
+
+type RPCRule struct {
+	Methods   []string `json:"methods"`              // method globs
+	ArgPrefix string   `json:"arg_prefix,omitempty"` // args[0] must start with it
+	Deny      bool     `json:"deny,omitempty"`
+}
+
+type SyncRule struct {
+	Methods []string `json:"methods,omitempty"` // sub|boardcast, empty means any, sub covers unsub
+	Topics  []string `json:"topics,omitempty"`  // topic globs, empty means any
+	Deny    bool     `json:"deny,omitempty"`
+}
+
+// topics of a user's notifications and logs, e.g. bob@notification, log:bob@3.
+// Others' log:{id} ones are only allowed by log grants, see EnableAuth.
+var (
+	ownTopics  = []string{"{name}@*", "log:{name}@*"}
+	userTopics = []string{"*@*"}
+)
+
+// roles defined by webasis, the auth file may override them
+func builtin_roles() map[string]RoleDef {
+	return map[string]RoleDef{
+		"root": {
+			RPC:  []RPCRule{{Methods: []string{"*"}}},
+			Sync: []SyncRule{{}},
+		},
+		"mask_user": {
+			RPC: []RPCRule{
+				{Methods: []string{"log/append", "log/get", "log/get/after", "log/close", "log/stat", "log/delete", "log/acl", "log/acl/*", "log/link", "log/links", "log/unlink"}, ArgPrefix: "{name}@"},
+				{Methods: []string{"admin*"}, Deny: true},
+				{Methods: []string{"*"}},
+			},
+			Sync: []SyncRule{
+				{Methods: []string{"boardcast"}, Deny: true},
+				{Topics: ownTopics},
+				{Topics: userTopics, Deny: true},
+				{},
+			},
+		},
+		"notification_sender": {
+			RPC: []RPCRule{{Methods: []string{"notify", "notify/schedule", "notify/schedules", "notify/cancel"}}},
+		},
+		"notification_receiver": {
+			RPC: []RPCRule{{Methods: []string{"log/get"}, ArgPrefix: "{name}@"}},
+			Sync: []SyncRule{
+				{Methods: []string{"boardcast"}, Deny: true},
+				{Topics: ownTopics},
+				{Topics: userTopics, Deny: true},
+				{},
+			},
+		},
+	}
+}
+
+// glob_match matches s against pattern, '*' matches any sequence including '/'
+// and nothing else is special. It is the dialect of roles, $WEBASIS_AUDIT_METHODS
+// and admin/audit; scoped tokens use path.Match, see scope_match.
+// On a mismatch only the last '*' takes one more byte, which is enough and
+// keeps it O(len(pattern)*len(s)).
+func glob_match(pattern, s string) bool {
+	p, i := 0, 0
+	star, next := -1, 0 // of the last '*' and where its match ends
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func glob_match_any(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if glob_match(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func sync_method_name(m wsync.AuthMethod) string {
+	if m == wsync.AuthMethod_Boardcast {
+		return "boardcast"
+	}
+	return "sub"
+}
+
+func (rule RPCRule) match(r wrpc.Req) bool {
+	return glob_match_any(rule.Methods, r.Method)
+}
+
+func (rule RPCRule) allow(name string, r wrpc.Req) bool {
+	if rule.Deny {
+		return false
+	}
+	if rule.ArgPrefix != "" {
+		prefix := strings.Replace(rule.ArgPrefix, "{name}", name, -1)
+		return len(r.Args) > 0 && strings.HasPrefix(r.Args[0], prefix)
+	}
+	return true
+}
+
+func (rule SyncRule) match(name string, m wsync.AuthMethod, topic string) bool {
+	if len(rule.Methods) > 0 && !glob_match_any(rule.Methods, sync_method_name(m)) {
+		return false
+	}
+	if len(rule.Topics) == 0 {
+		return true
+	}
+	for _, topicGlob := range rule.Topics {
+		if glob_match(strings.Replace(topicGlob, "{name}", name, -1), topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (def RoleDef) Compile() *wrbac.Role {
+	return &wrbac.Role{
+		Sync: func(token string, m wsync.AuthMethod, topic string) bool {
+			name, _ := wrbac.FromToken(token)
+			for _, rule := range def.Sync {
+				if rule.match(name, m, topic) {
+					return !rule.Deny
+				}
+			}
+			return false
+		},
+		RPC: func(r wrpc.Req) bool {
+			name, _ := wrbac.FromToken(r.Token)
+			for _, rule := range def.RPC {
+				if rule.match(r) {
+					return rule.allow(name, r)
+				}
+			}
+			return false
+		},
+	}
+}
+
+func (def RoleDef) Validate() error {
+	for i, rule := range def.RPC {
+		if len(rule.Methods) == 0 {
+			return fmt.Errorf("rpc rule %d: require methods", i)
+		}
+		for _, method := range rule.Methods {
+			if method == "" {
+				return fmt.Errorf("rpc rule %d: empty method", i)
+			}
+		}
+	}
+	for i, rule := range def.Sync {
+		for _, method := range rule.Methods {
+			switch method {
+			case "sub", "boardcast", "*":
+			default:
+				return fmt.Errorf("sync rule %d: unknown method: %s", i, method)
+			}
+		}
+	}
+	return nil
+}
+
+// Explain describes the rules in words, for cmd=check
+func (def RoleDef) Explain() []string {
+	lines := make([]string, 0, len(def.RPC)+len(def.Sync)+1)
+	for _, rule := range def.RPC {
+		line := "rpc  " + allow_word(rule.Deny) + " " + strings.Join(rule.Methods, ",")
+		if rule.ArgPrefix != "" && !rule.Deny {
+			line += " if args[0] starts with " + rule.ArgPrefix + ", else deny"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "rpc  deny  anything else")
+
+	for _, rule := range def.Sync {
+		methods, topics := "any method", "any topic"
+		if len(rule.Methods) > 0 {
+			methods = strings.Join(rule.Methods, ",")
+		}
+		if len(rule.Topics) > 0 {
+			topics = strings.Join(rule.Topics, ",")
+		}
+		lines = append(lines, "sync "+allow_word(rule.Deny)+" "+methods+" on "+topics)
+	}
+	lines = append(lines, "sync deny  anything else")
+	return lines
+}
+
+func allow_word(deny bool) string {
+	if deny {
+		return "deny "
+	}
+	return "allow"
+}
+
+// roles of the auth file override the builtin ones
+func merge_roles(defs map[string]RoleDef) map[string]RoleDef {
+	roles := builtin_roles()
+	for name, def := range defs {
+		roles[name] = def
+	}
+	return roles
+}
+
+func wrbac_register_role(rbac *wrbac.Table, defs map[string]RoleDef) error {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := make([]string, 0)
+	for _, name := range names {
+		def := defs[name]
+		if err := def.Validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("config error: role %s: %s", name, err))
+			continue
+		}
+		rbac.Register(name, def.Compile())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func explain_roles(defs map[string]RoleDef) {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Println("role:", name)
+		for _, line := range defs[name].Explain() {
+			fmt.Println("    " + line)
+		}
+	}
+}
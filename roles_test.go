@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wsync"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "log/get", true},
+		{"log/*", "log/get/after", true},
+		{"log/*", "log", false},
+		{"admin*", "admin/user/add", true},
+		{"?", "a", true},
+		{"?", "", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"{name}@*", "{name}@3", true},
+		{"*@*", "alice@notification", true},
+		{"*@*", "notify", false},
+		{"log:*@*", "log:alice@3", true},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a*b*c", "abbbc", true},
+		{"a*b*c", "acb", false},
+		{"**a", "ba", true},
+		{"a*", "a", true},
+	}
+	for _, tt := range tests {
+		if got := glob_match(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("glob_match(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGlobMatchLinear(t *testing.T) {
+	pattern := strings.Repeat("*a", 20) + "*b"
+	s := strings.Repeat("a", 5000)
+
+	start := time.Now()
+	if glob_match(pattern, s) {
+		t.Fatal("glob_match: expect no match")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("glob_match took %s", took)
+	}
+}
+
+// a user whose mask and only role are the role under test, so the table
+// decides like the role itself
+func role_table(t *testing.T, role string) (table *wrbac.Table, internal string) {
+	cfg := authConfig{Users: AuthModel{
+		"alice": {"test": User{Secret: "s3cret", Mask: role, Roles: []string{role}}},
+	}}
+	table, err := wrbac_build(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table, wrbac.ToToken("alice", "s3cret")
+}
+
+func TestBuiltinRolesRPC(t *testing.T) {
+	type call struct {
+		method string
+		arg    string
+	}
+	calls := map[string]call{
+		"own log":         {"log/get", "alice@3"},
+		"own append":      {"log/append", "alice@3"},
+		"other's log":     {"log/get", "bob@3"},
+		"system log":      {"log/get", "system@audit"},
+		"shared log":      {"log/get", own_log_id("alice", "bob@3")}, // as EnableAuth checks a grant
+		"system append":   {"log/append", "system@events"},
+		"notify":          {"notify", "hi"},
+		"notify/cancel":   {"notify/cancel", "alice@1"},
+		"notify prefs":    {"notify/prefs/set", "{}"},
+		"admin":           {"admin/user/list", ""},
+		"admin boardcast": {"admin/boardcast", "alice@notification"},
+	}
+	tests := []struct {
+		role    string
+		allowed []string // of calls, the others are denied
+	}{
+		{"root", []string{"own log", "own append", "other's log", "system log", "shared log", "system append", "notify", "notify/cancel", "notify prefs", "admin", "admin boardcast"}},
+		{"mask_user", []string{"own log", "own append", "shared log", "notify", "notify/cancel", "notify prefs"}},
+		{"notification_sender", []string{"notify", "notify/cancel"}},
+		{"notification_receiver", []string{"own log", "shared log"}},
+	}
+
+	for _, tt := range tests {
+		table, internal := role_table(t, tt.role)
+		allowed := make(map[string]bool)
+		for _, name := range tt.allowed {
+			allowed[name] = true
+		}
+		for name, c := range calls {
+			r := wrpc.Req{Token: internal, Method: c.method}
+			if c.arg != "" {
+				r.Args = []string{c.arg}
+			}
+			if got := table.AuthRPC(r); got != allowed[name] {
+				t.Errorf("%s: %s (%s %s) = %v, want %v", tt.role, name, c.method, c.arg, got, allowed[name])
+			}
+		}
+	}
+}
+
+func TestBuiltinRolesSync(t *testing.T) {
+	type sub struct {
+		method wsync.AuthMethod
+		topic  string
+	}
+	subs := map[string]sub{
+		"own notification":     {wsync.AuthMethod_Sub, "alice@notification"},
+		"own log":              {wsync.AuthMethod_Sub, "log:alice@3"},
+		"other's notification": {wsync.AuthMethod_Sub, "bob@notification"},
+		"other's log":          {wsync.AuthMethod_Sub, "log:bob@3"},
+		"system status":        {wsync.AuthMethod_Sub, "system@status"},
+		"system log":           {wsync.AuthMethod_Sub, "log:system@events"},
+		"shared log":           {wsync.AuthMethod_Sub, "log:" + own_log_id("alice", "bob@3")}, // as EnableAuth checks a grant
+		"logs":                 {wsync.AuthMethod_Sub, "logs"},
+		"unsub other's":        {wsync.AuthMethod_Unsub, "bob@notification"},
+		"boardcast own":        {wsync.AuthMethod_Boardcast, "alice@notification"},
+		"boardcast other's":    {wsync.AuthMethod_Boardcast, "bob@notification"},
+	}
+	tests := []struct {
+		role    string
+		allowed []string // of subs, the others are denied
+	}{
+		{"root", []string{"own notification", "own log", "other's notification", "other's log", "system status", "system log", "shared log", "logs", "unsub other's", "boardcast own", "boardcast other's"}},
+		{"mask_user", []string{"own notification", "own log", "shared log", "logs"}},
+		{"notification_sender", nil},
+		{"notification_receiver", []string{"own notification", "own log", "shared log", "logs"}},
+	}
+
+	for _, tt := range tests {
+		table, internal := role_table(t, tt.role)
+		allowed := make(map[string]bool)
+		for _, name := range tt.allowed {
+			allowed[name] = true
+		}
+		for name, s := range subs {
+			if got := table.AuthSync(internal, s.method, s.topic); got != allowed[name] {
+				t.Errorf("%s: %s (%s %s) = %v, want %v", tt.role, name, sync_method_name(s.method), s.topic, got, allowed[name])
+			}
+		}
+	}
+}
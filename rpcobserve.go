@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/webasis/wrpc"
+)
+
+// rpcCall is one wrpc call served over http, as seen by rpcObserver
+type rpcCall struct {
+	Req      wrpc.Req
+	Status   wrpc.Status // empty if the response could not be decoded
+	Reason   string      // first ret of a failed call, e.g. "args"
+	Remote   string
+	Start    time.Time
+	Latency  time.Duration
+	ReqSize  int
+	RespSize int
+}
+
+// rpcObserver wraps the /wrpc handler and reports every call to its
+// observers after it is served. Observers run in the request goroutine and
+// should be quick.
+type rpcObserver struct {
+	observers []func(call rpcCall)
+}
+
+func new_rpc_observer() *rpcObserver {
+	return &rpcObserver{}
+}
+
+// Add MUST be called before serving
+func (o *rpcObserver) Add(fn func(call rpcCall)) {
+	o.observers = append(o.observers, fn)
+}
+
+// only the head of a response is kept to find its status
+const respHeadSize = 4096
+
+type respRecorder struct {
+	http.ResponseWriter
+	head []byte
+	size int
+}
+
+func (w *respRecorder) Write(p []byte) (int, error) {
+	if room := respHeadSize - len(w.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		w.head = append(w.head, p[:room]...)
+	}
+	w.size += len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// decode_resp_status finds "status" in a possibly truncated json response
+func decode_resp_status(head []byte) wrpc.Status {
+	dec := json.NewDecoder(bytes.NewReader(head))
+	depth := 0
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		switch v := t.(type) {
+		case json.Delim:
+			if v == '{' || v == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		case string:
+			if depth == 1 && v == "status" {
+				if t, err := dec.Token(); err == nil {
+					if status, ok := t.(string); ok {
+						return wrpc.Status(status)
+					}
+				}
+				return ""
+			}
+		}
+	}
+}
+
+func (o *rpcObserver) Wrap(h http.Handler, maxContentLength int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(o.observers) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		raw, err := ioutil.ReadAll(io.LimitReader(r.Body, maxContentLength+1))
+		r.Body.Close()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(raw))
+
+		call := rpcCall{
+			Remote:  r.RemoteAddr,
+			Start:   time.Now(),
+			ReqSize: len(raw),
+		}
+		json.Unmarshal(raw, &call.Req)
+
+		rec := &respRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+
+		call.Latency = time.Since(call.Start)
+		call.RespSize = rec.size
+		call.Status = decode_resp_status(rec.head)
+		if call.Status != wrpc.StatusOK {
+			var resp wrpc.Resp
+			if json.Unmarshal(rec.head, &resp) == nil && len(resp.Rets) > 0 {
+				call.Reason = resp.Rets[0]
+			}
+		}
+		for _, fn := range o.observers {
+			fn(call)
+		}
+	})
+}
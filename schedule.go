@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+	"github.com/webasis/wsync"
+)
+
+type scheduleJob struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Kind    string `json:"kind"` // at|in|cron
+	Spec    string `json:"spec"`
+	Content string `json:"content"`
+	Next    int64  `json:"next"`
+}
+
+func (job scheduleJob) Stat() webasis.ScheduleJob {
+	return webasis.ScheduleJob{
+		Id:      job.Id,
+		Kind:    job.Kind,
+		Spec:    job.Spec,
+		Next:    time.Unix(job.Next, 0),
+		Content: job.Content,
+	}
+}
+
+type scheduleStore struct {
+	NextId int                     `json:"next_id"`
+	Jobs   map[string]*scheduleJob `json:"jobs"` // map[id]job
+}
+
+// at: 15:04 | 2006-01-02 15:04 | RFC3339 | unix seconds, 15:04 is the next one,
+// other past times are refused
+// in: duration, e.g. 2h30m
+// cron: minute hour day month weekday
+func schedule_next(kind, spec string, now time.Time) (time.Time, error) {
+	switch kind {
+	case "at":
+		if t, err := time.ParseInLocation("15:04", spec, time.Local); err == nil {
+			next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			return next, nil
+		}
+		var at time.Time
+		if t, err := time.ParseInLocation("2006-01-02 15:04", spec, time.Local); err == nil {
+			at = t
+		} else if t, err := time.Parse(time.RFC3339, spec); err == nil {
+			at = t
+		} else if sec, err := strconv.ParseInt(spec, 10, 64); err == nil {
+			at = time.Unix(sec, 0)
+		} else {
+			return time.Time{}, errors.New("bad time: " + spec)
+		}
+		if !at.After(now) {
+			return time.Time{}, errors.New("past time: " + spec)
+		}
+		return at, nil
+	case "in":
+		d, err := time.ParseDuration(spec)
+		if err != nil || d <= 0 {
+			return time.Time{}, errors.New("bad duration: " + spec)
+		}
+		return now.Add(d), nil
+	case "cron":
+		c, err := parse_cron(spec)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := c.Next(now)
+		if next.IsZero() {
+			return next, errors.New("cron: never fires: " + spec)
+		}
+		return next, nil
+	}
+	return time.Time{}, errors.New("bad kind: " + kind)
+}
+
+func load_schedules() scheduleStore {
+	store := scheduleStore{NextId: 1, Jobs: make(map[string]*scheduleJob)}
+	raw, err := ioutil.ReadFile(ScheduleFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			event_log("schedule").Error(err)
+		}
+		return store
+	}
+	if err := json.Unmarshal(raw, &store); err != nil {
+		event_log("schedule").Error(err)
+	}
+	if store.Jobs == nil {
+		store.Jobs = make(map[string]*scheduleJob)
+	}
+	return store
+}
+
+// write to a temporary file and rename, so a crash never leaves a partial file
+func write_file_atomic(filename string, data []byte, perm os.FileMode) error {
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// notify/schedule|kind|spec|content -> OK|id	kind: at|in|cron
+//
+//	error "limit" when the caller has $WEBASIS_MAX_SCHEDULES pending jobs
+//
+// notify/schedules -> OK{|id	kind	spec	next	content}
+// notify/cancel|id -> OK
+//
+// Pending jobs are saved to $WEBASIS_SCHEDULE_FILE and fire through notify.
+func EnableSchedule(rpc *wrpc.Server, sync *wsync.Server) {
+	store := load_schedules()
+
+	ch := make(chan func(), 100)
+	go func() {
+		for fn := range ch {
+			fn()
+		}
+	}()
+
+	save := func() {
+		raw, err := json.MarshalIndent(store, "", "\t")
+		if err == nil {
+			err = write_file_atomic(ScheduleFile, raw, 0600)
+		}
+		if err != nil {
+			event_log("schedule").WithField("file", ScheduleFile).Error(err)
+		}
+	}
+
+	fire := func(job scheduleJob) {
+		resp := rpc.CallWithoutAuth(wrpc.Req{
+			Token:  wrbac.ToToken(job.Name, ""),
+			Method: "notify",
+			Args:   []string{job.Content},
+		})
+		if resp.Status != wrpc.StatusOK {
+			event_log("schedule").WithField("id", job.Id).WithField("status", resp.Status).Error("schedule: fire")
+		}
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			ch <- func() {
+				now := time.Now()
+				changed := false
+				for id, job := range store.Jobs {
+					if job.Next > now.Unix() {
+						continue
+					}
+
+					go fire(*job)
+					changed = true
+
+					if job.Kind != "cron" {
+						delete(store.Jobs, id)
+						continue
+					}
+					next, err := schedule_next(job.Kind, job.Spec, now)
+					if err != nil {
+						delete(store.Jobs, id)
+						continue
+					}
+					job.Next = next.Unix()
+				}
+				if changed {
+					save()
+				}
+			}
+		}
+	}()
+
+	rpc.HandleFunc("notify/schedule", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 3 {
+			return wret.Error("args")
+		}
+
+		name, _ := wrbac.FromToken(r.Token)
+		kind, spec, content := r.Args[0], r.Args[1], r.Args[2]
+
+		next, err := schedule_next(kind, spec, time.Now())
+		if err != nil {
+			return wret.Error("args", err.Error())
+		}
+
+		id := make(chan string, 1)
+		ch <- func() {
+			pending := 0
+			for _, job := range store.Jobs {
+				if job.Name == name {
+					pending++
+				}
+			}
+			if pending >= MaxSchedules {
+				id <- ""
+				return
+			}
+
+			job := &scheduleJob{
+				Id:      name + "@" + strconv.Itoa(store.NextId),
+				Name:    name,
+				Kind:    kind,
+				Spec:    spec,
+				Content: content,
+				Next:    next.Unix(),
+			}
+			store.NextId++
+			store.Jobs[job.Id] = job
+			save()
+			id <- job.Id
+		}
+		ret := <-id
+		if ret == "" {
+			return wret.Error("limit")
+		}
+		return wret.OK(ret)
+	})
+
+	rpc.HandleFunc("notify/schedules", func(r wrpc.Req) wrpc.Resp {
+		name, _ := wrbac.FromToken(r.Token)
+
+		retJobs := make(chan []webasis.ScheduleJob, 1)
+		ch <- func() {
+			jobs := make([]webasis.ScheduleJob, 0)
+			for _, job := range store.Jobs {
+				if job.Name == name {
+					jobs = append(jobs, job.Stat())
+				}
+			}
+			retJobs <- jobs
+		}
+		jobs := <-retJobs
+		sort.Slice(jobs, func(i, j int) bool {
+			return jobs[i].Next.Before(jobs[j].Next)
+		})
+
+		rets := make([]string, len(jobs))
+		for i, job := range jobs {
+			rets[i] = job.Encode()
+		}
+		return wret.OK(rets...)
+	})
+
+	rpc.HandleFunc("notify/cancel", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+
+		name, _ := wrbac.FromToken(r.Token)
+		id := r.Args[0]
+
+		retOK := make(chan bool, 1)
+		ch <- func() {
+			job, ok := store.Jobs[id]
+			if !ok || job.Name != name {
+				retOK <- false
+				return
+			}
+			delete(store.Jobs, id)
+			save()
+			retOK <- true
+		}
+		if <-retOK {
+			return wret.OK()
+		}
+		return wret.Error("not_found")
+	})
+}
+
+func schedule() {
+	cmd := "help"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	ctx := context.TODO()
+	switch cmd {
+	case "at", "in", "cron":
+		if len(os.Args) < 4 {
+			schedule_help()
+			return
+		}
+		id, err := webasis.NotifySchedule(ctx, cmd, os.Args[2], strings.Join(os.Args[3:], " "))
+		ExitIfErr(err)
+		print_value("id", id)
+	case "list", "ls":
+		jobs, err := webasis.NotifySchedules(ctx)
+		ExitIfErr(err)
+
+		table := new_output("id", "kind", "spec", "next", "content")
+		for _, job := range jobs {
+			table.AddRow(map[string]interface{}{
+				"id":      job.Id,
+				"kind":    job.Kind,
+				"spec":    job.Spec,
+				"next":    job.Next.Format("2006-01-02 15:04"),
+				"content": job.Content,
+			})
+		}
+		table.Print()
+	case "cancel", "rm":
+		if len(os.Args) < 3 {
+			schedule_help()
+			return
+		}
+		for _, id := range os.Args[2:] {
+			ExitIfErr(webasis.NotifyCancel(ctx, id))
+		}
+	default:
+		schedule_help()
+	}
+}
+
+func schedule_help() {
+	fmt.Println("help:")
+	fmt.Println("\t", cliName+" at 15:04|'2006-01-02 15:04'|unix content")
+	fmt.Println("\t", cliName+" in duration content")
+	fmt.Println("\t", cliName+" cron 'minute hour day month weekday' content")
+	fmt.Println("\t", cliName+" list|ls")
+	fmt.Println("\t", cliName+" cancel|rm id {id}")
+	exit_usage()
+}
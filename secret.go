@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/webasis/wrbac"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hash_secret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func new_secret() string {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Match reports whether secret is the user's secret. Hash is preferred, a
+// plaintext Secret is still accepted for old auth files.
+func (user User) Match(secret string) bool {
+	if user.Hash != "" {
+		return bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(secret)) == nil
+	}
+	if user.Secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(user.Secret), []byte(secret)) == 1
+}
+
+// the secret loaded into wrbac, never given to clients when hashed
+func (user User) internalSecret() string {
+	if user.Hash != "" {
+		return user.Hash
+	}
+	return user.Secret
+}
+
+// failed tokens remembered by a tokenCache, it forgets all of them when full
+const maxFailedTokens = 10000
+
+// tokenCache maps client tokens to internal wrbac tokens, so bcrypt runs
+// once per token and model instead of once per call. Failed tokens are
+// remembered too, so retrying one costs nothing either.
+type tokenCache struct {
+	model AuthModel
+
+	lock   sync.Mutex
+	cache  map[[sha256.Size]byte]string // map[sha256(token)]internal token
+	failed map[[sha256.Size]byte]bool
+}
+
+func new_token_cache(model AuthModel) *tokenCache {
+	return &tokenCache{
+		model:  model,
+		cache:  make(map[[sha256.Size]byte]string),
+		failed: make(map[[sha256.Size]byte]bool),
+	}
+}
+
+// Resolve returns the internal token of token, ok is false if no user matches
+func (c *tokenCache) Resolve(token string) (internal string, ok bool) {
+	key := sha256.Sum256([]byte(token))
+
+	c.lock.Lock()
+	internal, ok = c.cache[key]
+	failed := c.failed[key]
+	c.lock.Unlock()
+	if ok {
+		return internal, true
+	}
+	if failed {
+		return "", false
+	}
+
+	name, secret := wrbac.FromToken(token)
+	if len(c.model[name]) == 0 {
+		return "", false
+	}
+	for _, user := range c.model[name] {
+		if user.Match(secret) {
+			internal = wrbac.ToToken(name, user.internalSecret())
+
+			c.lock.Lock()
+			c.cache[key] = internal
+			c.lock.Unlock()
+			return internal, true
+		}
+	}
+
+	c.lock.Lock()
+	if len(c.failed) >= maxFailedTokens {
+		c.failed = make(map[[sha256.Size]byte]bool)
+	}
+	c.failed[key] = true
+	c.lock.Unlock()
+	return "", false
+}
+
+// Cheap reports whether Resolve answers token without bcrypt
+func (c *tokenCache) Cheap(token string) bool {
+	key := sha256.Sum256([]byte(token))
+
+	c.lock.Lock()
+	_, ok := c.cache[key]
+	failed := c.failed[key]
+	c.lock.Unlock()
+	if ok || failed {
+		return true
+	}
+
+	name, _ := wrbac.FromToken(token)
+	return len(c.model[name]) == 0
+}
+
+// Add maps token to internal, e.g. for tokens of client certificates
+func (c *tokenCache) Add(token, internal string) {
+	key := sha256.Sum256([]byte(token))
+
+	c.lock.Lock()
+	c.cache[key] = internal
+	c.lock.Unlock()
+}
+
+// webasis name comment mask {roles}
+// prints a new token and the auth file entry holding its hash
+func gen_secret() {
+	if len(os.Args) < 4 {
+		fmt.Println(cliName + " name comment mask {roles}")
+		exit_usage()
+	}
+	name, desc, mask := os.Args[1], os.Args[2], os.Args[3]
+	roles := make([]string, 0)
+	if len(os.Args) > 4 {
+		roles = os.Args[4:]
+	}
+
+	secret := new_secret()
+	hash, err := hash_secret(secret)
+	ExitIfErr(err)
+
+	entry, err := json.MarshalIndent(AuthModel{
+		name: {desc: User{Hash: hash, Mask: mask, Roles: roles}},
+	}, "", "\t")
+	ExitIfErr(err)
+
+	fmt.Fprintln(os.Stderr, "token (shown once):")
+	fmt.Fprintln(os.Stderr, wrbac.ToToken(name, secret))
+	fmt.Println(string(entry))
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+)
+
+// shareLink gives read-only access to one log without an account. Its
+// secret is {id}.{random}, only the hash is kept.
+type shareLink struct {
+	Id      string `json:"id"`
+	Log     string `json:"log"`
+	Owner   string `json:"owner"`
+	Hash    string `json:"hash"` // hex sha256 of the secret
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"` // 0 means never
+}
+
+func (link *shareLink) Expired(now time.Time) bool {
+	return link.Expires != 0 && now.Unix() >= link.Expires
+}
+
+type shareLinks struct {
+	lock  sync.RWMutex
+	links map[string]*shareLink // map[id]link
+}
+
+func new_share_links() *shareLinks {
+	s := &shareLinks{links: make(map[string]*shareLink)}
+	raw, err := ioutil.ReadFile(ShareFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			event_log("share").Error(err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(raw, &s.links); err != nil {
+		event_log("share").Error(err)
+	}
+	return s
+}
+
+// save MUST be called with lock held
+func (s *shareLinks) save() {
+	raw, err := json.MarshalIndent(s.links, "", "\t")
+	if err == nil {
+		err = write_file_atomic(ShareFile, raw, 0600)
+	}
+	if err != nil {
+		event_log("share").WithField("file", ShareFile).Error(err)
+	}
+}
+
+func (s *shareLinks) Create(log, owner string, ttl time.Duration) (secret string, link *shareLink) {
+	now := time.Now()
+	link = &shareLink{
+		Id:      new_secret()[:16],
+		Log:     log,
+		Owner:   owner,
+		Created: now.Unix(),
+	}
+	if ttl > 0 {
+		link.Expires = now.Add(ttl).Unix()
+	}
+	secret = link.Id + "." + new_secret()
+	sum := sha256.Sum256([]byte(secret))
+	link.Hash = hex.EncodeToString(sum[:])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, old := range s.links {
+		if old.Expired(now) {
+			delete(s.links, id)
+		}
+	}
+	s.links[link.Id] = link
+	s.save()
+	return secret, link
+}
+
+// Lookup returns the unexpired link of secret
+func (s *shareLinks) Lookup(secret string) (*shareLink, bool) {
+	id := strings.SplitN(secret, ".", 2)[0]
+
+	s.lock.RLock()
+	link, ok := s.links[id]
+	s.lock.RUnlock()
+	if !ok || link.Expired(time.Now()) {
+		return nil, false
+	}
+
+	sum := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(link.Hash)) != 1 {
+		return nil, false
+	}
+	return link, true
+}
+
+// List returns links of log
+func (s *shareLinks) List(log string) []*shareLink {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	links := make([]*shareLink, 0)
+	for _, link := range s.links {
+		if link.Log == log && !link.Expired(now) {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Created < links[j].Created
+	})
+	return links
+}
+
+func (s *shareLinks) Revoke(log, id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	link, ok := s.links[id]
+	if !ok || link.Log != log {
+		return false
+	}
+	delete(s.links, id)
+	s.save()
+	return true
+}
+
+// Drop removes all links of log, e.g. when it is deleted
+func (s *shareLinks) Drop(log string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dropped := false
+	for id, link := range s.links {
+		if link.Log == log {
+			delete(s.links, id)
+			dropped = true
+		}
+	}
+	if dropped {
+		s.save()
+	}
+}
+
+type shareLogResp struct {
+	Id     string   `json:"id"`
+	Name   string   `json:"name"`
+	Closed bool     `json:"closed"`
+	Line   int      `json:"line"`
+	Start  int      `json:"start"`
+	Logs   []string `json:"logs"`
+}
+
+// log/link|id[|ttl] -> OK|link_id|url	ttl: duration, empty means never expires
+// log/links|id -> OK{|link_id	created	expires}
+// log/unlink|id|link_id -> OK
+//
+// GET /share/{secret} -> html viewer
+// GET /api/share/{secret}?start=int -> json of shareLogResp	start: of the logs, past dropped lines
+//
+// Authorization is done by EnableAuth: these methods need admin on id.
+func EnableShare(rpc *wrpc.Server, links *shareLinks) {
+	rpc.HandleFunc("log/link", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return wret.Error("args")
+		}
+		fields := webasis.Fields(r.Args)
+		id := fields.Get(0, "")
+
+		var ttl time.Duration
+		if raw := fields.Get(1, ""); raw != "" {
+			var err error
+			ttl, err = time.ParseDuration(raw)
+			if err != nil || ttl <= 0 {
+				return wret.Error("args", "ttl")
+			}
+		}
+
+		stat := rpc.CallWithoutAuth(wrpc.Req{Method: "log/stat", Args: []string{id}})
+		if stat.Status != wrpc.StatusOK {
+			return stat
+		}
+
+		owner, _ := wrbac.FromToken(r.Token)
+		secret, link := links.Create(id, owner, ttl)
+		return wret.OK(link.Id, PublicURL+"/share/"+secret)
+	})
+
+	rpc.HandleFunc("log/links", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+
+		rets := make([]string, 0)
+		for _, link := range links.List(r.Args[0]) {
+			rets = append(rets, strings.Join([]string{link.Id, webasis.Int(int(link.Created)), webasis.Int(int(link.Expires))}, "\t"))
+		}
+		return wret.OK(rets...)
+	})
+
+	rpc.HandleFunc("log/unlink", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 2 {
+			return wret.Error("args")
+		}
+		if !links.Revoke(r.Args[0], r.Args[1]) {
+			return wret.Error("not_found")
+		}
+		return wret.OK()
+	})
+
+	http.HandleFunc("/share/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := links.Lookup(strings.TrimPrefix(r.URL.Path, "/share/")); !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Write([]byte(shareViewerHTML))
+	})
+
+	http.HandleFunc("/api/share/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		link, ok := links.Lookup(strings.TrimPrefix(r.URL.Path, "/api/share/"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		if start < 0 {
+			start = 0
+		}
+
+		stat := rpc.CallWithoutAuth(wrpc.Req{Method: "log/stat", Args: []string{link.Log}})
+		if stat.Status != wrpc.StatusOK {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fields := webasis.Fields(stat.Rets)
+		if first := fields.Int(5, 0); start < first {
+			// dropped lines are gone, go on from the oldest kept one
+			start = first
+		}
+		logs := rpc.CallWithoutAuth(wrpc.Req{
+			Method: "log/get",
+			Args:   []string{link.Log, webasis.Int(start), webasis.Int(1000), webasis.Int(1024 * 1024)},
+		})
+		if logs.Status != wrpc.StatusOK {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shareLogResp{
+			Id:     link.Log,
+			Name:   fields.Get(0, ""),
+			Closed: fields.Bool(3, true),
+			Line:   fields.Int(2, 0),
+			Start:  start,
+			Logs:   logs.Rets,
+		})
+	})
+}
+
+const shareViewerHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>webasis log</title>
+<style>
+body { margin: 0; font-family: sans-serif; background: #1e1e1e; color: #ddd; }
+header { padding: 8px 12px; background: #333; }
+#status { color: #999; margin-left: 8px; }
+pre { margin: 0; padding: 12px; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<header><b id="name">loading</b><span id="status"></span></header>
+<pre id="logs"></pre>
+<script>
+var secret = location.pathname.split("/").pop();
+var start = 0;
+function poll() {
+	fetch("/api/share/" + secret + "?start=" + start).then(function (resp) {
+		if (!resp.ok) { throw new Error(resp.status); }
+		return resp.json();
+	}).then(function (data) {
+		document.title = data.name;
+		document.getElementById("name").textContent = data.name;
+		document.getElementById("status").textContent = data.closed ? "closed" : "live";
+		start = data.start;
+		if (data.logs && data.logs.length > 0) {
+			document.getElementById("logs").appendChild(document.createTextNode(data.logs.join("\n") + "\n"));
+			start += data.logs.length;
+		}
+		if (!data.closed || start < data.line) {
+			setTimeout(poll, start < data.line ? 0 : 2000);
+		}
+	}).catch(function (err) {
+		document.getElementById("status").textContent = "unavailable";
+	});
+}
+poll();
+</script>
+</body>
+</html>
+`
@@ -1,17 +1,207 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
 	"github.com/webasis/wrpc"
 	"github.com/webasis/wrpc/wret"
 	"github.com/webasis/wsync"
 )
 
+// Version of the daemon, set at build time:
+// go build -ldflags "-X main.Version=v1.2.3"
+var Version = "dev"
+
+// latencies kept per method for percentiles
+const latencySamples = 1000
+
+// callers and error reasons beyond it are counted as "other", like methods
+const maxStatusKeys = 500
+
+type methodStatus struct {
+	calls     int
+	errors    int
+	latencies []time.Duration // ring of the latest calls
+	next      int
+}
+
+// percentiles of the latest calls, ps in (0, 1]
+func (s *methodStatus) percentiles(ps ...float64) []time.Duration {
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	ret := make([]time.Duration, len(ps))
+	if len(sorted) == 0 {
+		return ret
+	}
+	for i, p := range ps {
+		index := int(p*float64(len(sorted))+0.5) - 1
+		if index < 0 {
+			index = 0
+		}
+		if index >= len(sorted) {
+			index = len(sorted) - 1
+		}
+		ret[i] = sorted[index]
+	}
+	return ret
+}
+
+// callStatus counts calls served on /wrpc, see rpcObserver
+type callStatus struct {
+	lock    sync.Mutex
+	methods map[string]*methodStatus
+	errors  map[[2]string]int  // map[{status, reason}]count
+	users   map[string]*[2]int // map[name]{calls, errors}
+}
+
+func new_call_status() *callStatus {
+	return &callStatus{
+		methods: make(map[string]*methodStatus),
+		errors:  make(map[[2]string]int),
+		users:   make(map[string]*[2]int),
+	}
+}
+
+func (s *callStatus) Observe(call rpcCall) {
+	method, status, reason := call.Req.Method, string(call.Status), call.Reason
+	if status == "" {
+		status = "unknown"
+	}
+	if len(reason) > 64 {
+		reason = reason[:64]
+	}
+	failed := call.Status != wrpc.StatusOK
+
+	// callers of failed auth may be anything
+	user := "-"
+	if call.Status != wrpc.StatusAuth {
+		user, _ = wrbac.FromToken(call.Req.Token)
+	}
+	if user == "" {
+		user = "-"
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.methods[method]
+	if !ok {
+		if len(s.methods) >= maxMetricMethods {
+			method = "other"
+			m = s.methods[method]
+		}
+		if m == nil {
+			m = &methodStatus{}
+			s.methods[method] = m
+		}
+	}
+	m.calls++
+	if len(m.latencies) < latencySamples {
+		m.latencies = append(m.latencies, call.Latency)
+	} else {
+		m.latencies[m.next] = call.Latency
+		m.next = (m.next + 1) % latencySamples
+	}
+
+	u, ok := s.users[user]
+	if !ok {
+		if len(s.users) >= maxStatusKeys {
+			user = "other"
+			u = s.users[user]
+		}
+		if u == nil {
+			u = &[2]int{}
+			s.users[user] = u
+		}
+	}
+	u[0]++
+
+	if !failed {
+		return
+	}
+	m.errors++
+	u[1]++
+
+	key := [2]string{status, reason}
+	if _, ok := s.errors[key]; !ok && len(s.errors) >= maxStatusKeys {
+		key[1] = "other"
+	}
+	s.errors[key]++
+}
+
+func (s *callStatus) Methods() []webasis.MethodStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := make([]webasis.MethodStat, 0, len(s.methods))
+	for method, m := range s.methods {
+		ps := m.percentiles(0.5, 0.9, 0.99)
+		stats = append(stats, webasis.MethodStat{
+			Method: method,
+			Calls:  m.calls,
+			Errors: m.errors,
+			P50:    ps[0],
+			P90:    ps[1],
+			P99:    ps[2],
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Calls > stats[j].Calls })
+	return stats
+}
+
+func (s *callStatus) Errors() []webasis.ErrorStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := make([]webasis.ErrorStat, 0, len(s.errors))
+	for key, count := range s.errors {
+		stats = append(stats, webasis.ErrorStat{Status: key[0], Reason: key[1], Count: count})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Count > stats[j].Count })
+	return stats
+}
+
+func (s *callStatus) Users() []webasis.UserStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := make([]webasis.UserStat, 0, len(s.users))
+	for name, u := range s.users {
+		stats = append(stats, webasis.UserStat{Name: name, Calls: u[0], Errors: u[1]})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Calls > stats[j].Calls })
+	return stats
+}
+
 // admin/status/wsync/connected -> OK|count
 // admin/status/wsync/message -> OK|count
 // admin/status/wrpc/called -> OK|count
-func EnableStatus(rpc *wrpc.Server, sync *wsync.Server) {
+// admin/status/wrpc/methods -> OK{|method	calls	errors	p50	p90	p99}	latency in µs, most called first
+// admin/status/wrpc/errors -> OK{|status	reason	count}
+// admin/status/wrpc/users -> OK{|name	calls	errors}
+// admin/status/server -> OK|started|uptime|version|go_version	in seconds
+// admin/status/weblog -> OK|logs|closed|size|lines
+// admin/status[|max_logs] -> OK|json	webasis.Status, with the latest created logs
+//
+// The counters are boardcast on webasis.StatusTopic when they change, at most
+// once a second.
+//
+// Methods, errors and users count calls served on /wrpc, not the daemon's
+// own ones.
+func EnableStatus(rpc *wrpc.Server, sync *wsync.Server, observer *rpcObserver) {
+	started := time.Now()
+	calls := new_call_status()
+	observer.Add(calls.Observe)
+
 	rpc.HandleFunc("admin/status/wsync/connected", func(r wrpc.Req) wrpc.Resp {
 		ch := make(chan int, 1)
 		sync.C <- func(sync *wsync.Server) {
@@ -41,4 +231,128 @@ func EnableStatus(rpc *wrpc.Server, sync *wsync.Server) {
 		return wret.OK(fmt.Sprint(ss.Count))
 	})
 
+	rpc.HandleFunc("admin/status/wrpc/methods", func(r wrpc.Req) wrpc.Resp {
+		stats := calls.Methods()
+		rets := make([]string, len(stats))
+		for i, stat := range stats {
+			rets[i] = stat.Encode()
+		}
+		return wret.OK(rets...)
+	})
+
+	rpc.HandleFunc("admin/status/wrpc/errors", func(r wrpc.Req) wrpc.Resp {
+		stats := calls.Errors()
+		rets := make([]string, len(stats))
+		for i, stat := range stats {
+			rets[i] = stat.Encode()
+		}
+		return wret.OK(rets...)
+	})
+
+	rpc.HandleFunc("admin/status/wrpc/users", func(r wrpc.Req) wrpc.Resp {
+		stats := calls.Users()
+		rets := make([]string, len(stats))
+		for i, stat := range stats {
+			rets[i] = stat.Encode()
+		}
+		return wret.OK(rets...)
+	})
+
+	server := func() webasis.ServerStat {
+		return webasis.ServerStat{
+			Started:   started,
+			Uptime:    time.Since(started) / time.Second * time.Second,
+			Version:   Version,
+			GoVersion: runtime.Version(),
+		}
+	}
+
+	// logs are the latest created max_logs ones
+	weblog := func(max_logs int) (totals webasis.WebLogTotals, logs []webasis.WebLogStat, resp wrpc.Resp) {
+		resp = rpc.CallWithoutAuth(wrpc.Req{Method: "admin/log/all"})
+		if resp.Status != wrpc.StatusOK {
+			return
+		}
+
+		logs = make([]webasis.WebLogStat, 0, len(resp.Rets))
+		for _, raw := range resp.Rets {
+			stat := webasis.DecodeWebLogStat(raw)
+			totals.Logs++
+			if stat.Closed {
+				totals.Closed++
+			}
+			totals.Size += stat.Size
+			totals.Lines += stat.Line
+			logs = append(logs, stat)
+		}
+		sort.Slice(logs, func(i, j int) bool { return logs[i].Created.After(logs[j].Created) })
+		if len(logs) > max_logs {
+			logs = logs[:max_logs]
+		}
+		return
+	}
+
+	rpc.HandleFunc("admin/status/server", func(r wrpc.Req) wrpc.Resp {
+		s := server()
+		return wret.OK(fmt.Sprint(s.Started.Unix()), fmt.Sprint(int64(s.Uptime/time.Second)), s.Version, s.GoVersion)
+	})
+
+	rpc.HandleFunc("admin/status/weblog", func(r wrpc.Req) wrpc.Resp {
+		totals, _, resp := weblog(0)
+		if resp.Status != wrpc.StatusOK {
+			return resp
+		}
+		return wret.OK(fmt.Sprint(totals.Logs), fmt.Sprint(totals.Closed), fmt.Sprint(totals.Size), fmt.Sprint(totals.Lines))
+	})
+
+	rpc.HandleFunc("admin/status", func(r wrpc.Req) wrpc.Resp {
+		max_logs := 0
+		if len(r.Args) > 0 {
+			n, err := strconv.Atoi(r.Args[0])
+			if err != nil || n < 0 {
+				return wret.Error("args")
+			}
+			max_logs = n
+		}
+
+		status := webasis.Status{
+			Server:  server(),
+			Called:  rpc.Status().Count,
+			Methods: calls.Methods(),
+			Errors:  calls.Errors(),
+			Users:   calls.Users(),
+		}
+		status.WebLog, status.Logs, _ = weblog(max_logs)
+
+		ret := make(chan [2]int, 1)
+		sync.C <- func(sync *wsync.Server) {
+			ret <- [2]int{len(sync.Agents), sync.MessageSent}
+		}
+		counts := <-ret
+		status.Connected, status.Message = counts[0], counts[1]
+
+		raw, err := json.Marshal(status)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+		return wret.OK(string(raw))
+	})
+
+	// push counters to watchers instead of being polled, a boardcast is
+	// not a change itself
+	go func() {
+		var last [3]int
+		for range time.Tick(time.Second) {
+			called := rpc.Status().Count
+			sync.C <- func(sync *wsync.Server) {
+				counts := [3]int{len(sync.Agents), sync.MessageSent, called}
+				if counts == last {
+					return
+				}
+				sync.Boardcast(webasis.StatusTopic, webasis.Int(counts[0]), webasis.Int(counts[1]), webasis.Int(counts[2]))
+				last = counts
+				last[1] = sync.MessageSent
+			}
+		}
+	}()
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webasis/wrbac"
+)
+
+// certReloader serves the certificate of SSLCert and SSLKey and reloads it
+// when one of the files changes
+type certReloader struct {
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func new_cert_reloader() (*certReloader, error) {
+	c := &certReloader{}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			time.Sleep(SSLWatchInterval)
+			if cert_mod_time().Equal(c.modTime) {
+				continue
+			}
+			l := event_log("tls").WithField("cert", SSLCert)
+			if err := c.load(); err != nil {
+				// a renewal may write the files one by one, keep the old one
+				l.Error("cert reload: ", err)
+				continue
+			}
+			l.Info("cert reload")
+		}
+	}()
+	return c, nil
+}
+
+func cert_mod_time() time.Time {
+	var t time.Time
+	for _, name := range []string{SSLCert, SSLKey} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t
+}
+
+func (c *certReloader) load() error {
+	modTime := cert_mod_time()
+	cert, err := tls.LoadX509KeyPair(SSLCert, SSLKey)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tls_cipher_suites refuses tls.InsecureCipherSuites()
+func tls_cipher_suites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		if insecure[name] {
+			return nil, fmt.Errorf("insecure cipher suite: %s", name)
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// new_tls_config builds the config of WEBASIS_SSL_*
+func new_tls_config() (*tls.Config, error) {
+	certs, err := new_cert_reloader()
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion, ok := tlsVersions[SSLMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls version: %s", SSLMinVersion)
+	}
+	ciphers, err := tls_cipher_suites(split_list(SSLCiphers))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     minVersion,
+	}
+	if len(ciphers) > 0 {
+		cfg.CipherSuites = ciphers
+	}
+
+	if SSLClientCA != "" {
+		raw, err := ioutil.ReadFile(SSLClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, errors.New("no certificate in " + SSLClientCA)
+		}
+		cfg.ClientCAs = pool
+
+		switch SSLClientAuth {
+		case "optional":
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("unknown client auth: %s", SSLClientAuth)
+		}
+	}
+	return cfg, nil
+}
+
+// tokens of client certificates only live in this process
+var certTokenKey = []byte(new_secret())
+
+// cert_token derives the token of a credential's client certificate, it
+// changes when the credential does
+func cert_token(name, desc string, user User) string {
+	mac := hmac.New(sha256.New, certTokenKey)
+	mac.Write([]byte(strings.Join([]string{name, desc, user.Cert, user.internalSecret()}, "\n")))
+	return wrbac.ToToken(name, "x509_"+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// cert_auth authenticates requests with a verified client certificate mapped
+// to a user as if they sent its token in the Authorization header
+func cert_auth(h http.Handler, state func() *authState) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && r.Header.Get("Authorization") == "" {
+			subject := r.TLS.VerifiedChains[0][0].Subject.String()
+			if token, ok := state().CertToken(subject); ok {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
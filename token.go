@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+)
+
+// scopedToken is derived from a credential of the auth model. It expires,
+// holds a subset of the credential's roles and may be limited to some
+// methods and wsync topics. Its secret is st_{id}_{random}.
+type scopedToken struct {
+	Id      string   `json:"id"`
+	Name    string   `json:"name"`
+	Parent  string   `json:"parent"` // comment of the credential it derives from
+	Comment string   `json:"comment,omitempty"`
+	Hash    string   `json:"hash"` // hex sha256 of the secret
+	Created int64    `json:"created"`
+	Expires int64    `json:"expires"`
+	Roles   []string `json:"roles"`
+	Methods []string `json:"methods,omitempty"` // "method_glob[ arg0_glob]", empty means any
+	Topics  []string `json:"topics,omitempty"`  // topic globs, empty means any
+}
+
+// scope_match matches globs of scoped tokens like path.Match: '*' stops at
+// '/' and '?', '[...]' and '\' are special, unlike glob_match of roles
+func scope_match(pattern, s string) bool {
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+const scopedTokenPrefix = "st_"
+
+func (t *scopedToken) internalToken() string {
+	return wrbac.ToToken(t.Name, scopedTokenPrefix+t.Id)
+}
+
+func (t *scopedToken) Expired(now time.Time) bool {
+	return now.Unix() >= t.Expires
+}
+
+func (t *scopedToken) AllowRPC(r wrpc.Req) bool {
+	if len(t.Methods) == 0 {
+		return true
+	}
+	for _, rule := range t.Methods {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		if !scope_match(fields[0], r.Method) {
+			continue
+		}
+		if len(fields) == 1 {
+			return true
+		}
+		if len(r.Args) > 0 {
+			if scope_match(fields[1], r.Args[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *scopedToken) AllowTopic(topic string) bool {
+	if len(t.Topics) == 0 {
+		return true
+	}
+	for _, glob := range t.Topics {
+		if scope_match(glob, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *scopedToken) Stat() webasis.ScopedToken {
+	return webasis.ScopedToken{
+		Id:      t.Id,
+		Name:    t.Name,
+		Comment: t.Comment,
+		Expires: time.Unix(t.Expires, 0),
+		Roles:   t.Roles,
+		Methods: t.Methods,
+		Topics:  t.Topics,
+	}
+}
+
+type scopedTokens map[string]*scopedToken // map[id]token
+
+func (tokens scopedTokens) clone() scopedTokens {
+	ret := make(scopedTokens, len(tokens))
+	for id, t := range tokens {
+		ret[id] = t
+	}
+	return ret
+}
+
+// Lookup returns the unexpired scoped token of token
+func (tokens scopedTokens) Lookup(token string, now time.Time) (*scopedToken, bool) {
+	name, secret := wrbac.FromToken(token)
+	if !strings.HasPrefix(secret, scopedTokenPrefix) {
+		return nil, false
+	}
+	parts := strings.SplitN(secret[len(scopedTokenPrefix):], "_", 2)
+
+	t, ok := tokens[parts[0]]
+	if !ok || t.Name != name || t.Expired(now) {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(t.Hash)) != 1 {
+		return nil, false
+	}
+	return t, true
+}
+
+func load_scoped_tokens() scopedTokens {
+	tokens := make(scopedTokens)
+	raw, err := ioutil.ReadFile(TokenFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			event_log("token").Error(err)
+		}
+		return tokens
+	}
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		event_log("token").Error(err)
+	}
+	return tokens
+}
+
+func save_scoped_tokens(tokens scopedTokens) error {
+	raw, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		return err
+	}
+	return write_file_atomic(TokenFile, raw, 0600)
+}
+
+func split_list(raw string) []string {
+	ret := make([]string, 0)
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// token/mint|ttl|roles|methods|topics[|comment] -> OK|id|token
+// token/list -> OK{|id	name	comment	expires	roles	methods	topics}
+// token/revoke|id -> OK
+// admin/token/list -> OK{|id	name	comment	expires	roles	methods	topics}
+// admin/token/revoke|id -> OK
+//
+// roles, methods and topics are separated by ','. Empty roles means all roles
+// of the caller, empty methods or topics means any. A method rule is
+// "method_glob[ arg0_glob]", e.g. "log/append ci@*". Globs are path.Match
+// ones, '*' doesn't match '/'.
+func EnableScopedTokens(rpc *wrpc.Server, mutate func(fn func(tokens scopedTokens, model AuthModel) wrpc.Resp) wrpc.Resp, state func() *authState) {
+	list := func(name string) wrpc.Resp {
+		stats := make([]webasis.ScopedToken, 0)
+		now := time.Now()
+		for _, t := range state().scoped {
+			if (name == "" || t.Name == name) && !t.Expired(now) {
+				stats = append(stats, t.Stat())
+			}
+		}
+		sort.Slice(stats, func(i, j int) bool {
+			return stats[i].Expires.Before(stats[j].Expires)
+		})
+
+		rets := make([]string, len(stats))
+		for i, stat := range stats {
+			rets[i] = stat.Encode()
+		}
+		return wret.OK(rets...)
+	}
+
+	revoke := func(name, id string) wrpc.Resp {
+		return mutate(func(tokens scopedTokens, model AuthModel) wrpc.Resp {
+			t, ok := tokens[id]
+			if !ok || (name != "" && t.Name != name) {
+				return wret.Error("not_found")
+			}
+			delete(tokens, id)
+			return wret.OK()
+		})
+	}
+
+	rpc.HandleFunc("token/mint", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 4 || len(r.Args) > 5 {
+			return wret.Error("args")
+		}
+		fields := webasis.Fields(r.Args)
+
+		ttl, err := time.ParseDuration(fields.Get(0, ""))
+		if err != nil || ttl <= 0 || ttl > ScopedTokenMaxTTL {
+			return wret.Error("args", "ttl")
+		}
+
+		s := state()
+		internal, scope, ok := s.Resolve(r.Token)
+		if !ok {
+			return wret.Error("auth")
+		}
+		if scope != nil {
+			return wret.Error("scoped")
+		}
+
+		name, _ := wrbac.FromToken(r.Token)
+		parent, found := "", false
+		for desc, u := range s.model[name] {
+			if wrbac.ToToken(name, u.internalSecret()) == internal {
+				parent, found = desc, true
+				break
+			}
+		}
+		if !found {
+			return wret.Error("not_found")
+		}
+
+		owned := make(map[string]bool)
+		for _, role := range s.model[name][parent].Roles {
+			owned[role] = true
+		}
+		roles := split_list(fields.Get(1, ""))
+		if len(roles) == 0 {
+			roles = append(roles, s.model[name][parent].Roles...)
+		}
+		for _, role := range roles {
+			if !owned[role] {
+				return wret.Error("args", "role: "+role)
+			}
+		}
+
+		methods, topics := split_list(fields.Get(2, "")), split_list(fields.Get(3, ""))
+		globs := append([]string(nil), topics...)
+		for _, rule := range methods {
+			globs = append(globs, strings.Fields(rule)...)
+		}
+		for _, glob := range globs {
+			if _, err := path.Match(glob, ""); err != nil {
+				return wret.Error("args", "glob: "+glob)
+			}
+		}
+
+		now := time.Now()
+		t := &scopedToken{
+			Id:      new_secret()[:16],
+			Name:    name,
+			Parent:  parent,
+			Comment: fields.Get(4, ""),
+			Created: now.Unix(),
+			Expires: now.Add(ttl).Unix(),
+			Roles:   roles,
+			Methods: methods,
+			Topics:  topics,
+		}
+		secret := scopedTokenPrefix + t.Id + "_" + new_secret()
+		sum := sha256.Sum256([]byte(secret))
+		t.Hash = hex.EncodeToString(sum[:])
+
+		resp := mutate(func(tokens scopedTokens, model AuthModel) wrpc.Resp {
+			for id, old := range tokens {
+				if old.Expired(now) {
+					delete(tokens, id)
+				}
+			}
+			tokens[t.Id] = t
+			return wret.OK()
+		})
+		if resp.Status != wrpc.StatusOK {
+			return resp
+		}
+		return wret.OK(t.Id, wrbac.ToToken(name, secret))
+	})
+
+	rpc.HandleFunc("token/list", func(r wrpc.Req) wrpc.Resp {
+		name, _ := wrbac.FromToken(r.Token)
+		return list(name)
+	})
+
+	rpc.HandleFunc("token/revoke", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+		name, _ := wrbac.FromToken(r.Token)
+		return revoke(name, r.Args[0])
+	})
+
+	rpc.HandleFunc("admin/token/list", func(r wrpc.Req) wrpc.Resp {
+		return list("")
+	})
+
+	rpc.HandleFunc("admin/token/revoke", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 1 {
+			return wret.Error("args")
+		}
+		return revoke("", r.Args[0])
+	})
+}
+
+func token() {
+	cmd := "help"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	ctx := context.TODO()
+	switch cmd {
+	case "mint":
+		if len(os.Args) < 3 {
+			token_help()
+			return
+		}
+		fields := webasis.Fields(os.Args[2:])
+		id, t, err := webasis.TokenMint(ctx, fields.Get(0, ""), fields.Get(1, ""), fields.Get(2, ""), fields.Get(3, ""), fields.Get(4, ""))
+		ExitIfErr(err)
+		fmt.Fprintln(os.Stderr, "id:", id)
+		print_value("token", t)
+	case "list", "ls":
+		tokens, err := webasis.TokenList(ctx)
+		ExitIfErr(err)
+
+		table := new_output("id", "comment", "expires", "roles", "methods", "topics")
+		for _, t := range tokens {
+			table.AddRow(map[string]interface{}{
+				"id":      t.Id,
+				"comment": t.Comment,
+				"expires": t.Expires.Format("2006-01-02 15:04"),
+				"roles":   strings.Join(t.Roles, ","),
+				"methods": strings.Join(t.Methods, ","),
+				"topics":  strings.Join(t.Topics, ","),
+			})
+		}
+		table.Print()
+	case "revoke", "rm":
+		if len(os.Args) < 3 {
+			token_help()
+			return
+		}
+		for _, id := range os.Args[2:] {
+			ExitIfErr(webasis.TokenRevoke(ctx, id))
+		}
+	default:
+		token_help()
+	}
+}
+
+func token_help() {
+	fmt.Println("help:")
+	fmt.Println("\t", cliName+" mint ttl [roles [methods [topics [comment]]]]")
+	fmt.Println("\t", cliName+" list|ls")
+	fmt.Println("\t", cliName+" revoke|rm id {id}")
+	exit_usage()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/webasis/wrpc"
+)
+
+func TestScopedTokenGlobs(t *testing.T) {
+	scope := &scopedToken{
+		Methods: []string{"log/*", "notify", "log/append/* ci@*"},
+		Topics:  []string{"log:ci@*", "ci@notification"},
+	}
+
+	calls := []struct {
+		method string
+		args   []string
+		want   bool
+	}{
+		{"log/get", []string{"alice@1"}, true},
+		{"log/get/after", []string{"alice@1"}, false}, // '*' stops at '/'
+		{"notify", nil, true},
+		{"notify/schedule", nil, false},
+		{"log/append/x", []string{"ci@3"}, true},
+		{"log/append/x", []string{"alice@3"}, false},
+		{"log/append/x", nil, false},
+	}
+	for _, c := range calls {
+		if got := scope.AllowRPC(wrpc.Req{Method: c.method, Args: c.args}); got != c.want {
+			t.Errorf("AllowRPC(%s %v) = %v, want %v", c.method, c.args, got, c.want)
+		}
+	}
+
+	topics := []struct {
+		topic string
+		want  bool
+	}{
+		{"log:ci@3", true},
+		{"log:ci@3/x", false},
+		{"ci@notification", true},
+		{"alice@notification", false},
+	}
+	for _, c := range topics {
+		if got := scope.AllowTopic(c.topic); got != c.want {
+			t.Errorf("AllowTopic(%s) = %v, want %v", c.topic, got, c.want)
+		}
+	}
+}
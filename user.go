@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wrpc"
+	"github.com/webasis/wrpc/wret"
+)
+
+type userAudit struct {
+	Time    int64    `json:"time"`
+	Caller  string   `json:"caller"`
+	Action  string   `json:"action"`
+	Name    string   `json:"name"`
+	Comment string   `json:"comment,omitempty"`
+	Mask    string   `json:"mask,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+}
+
+func write_user_audit(audit userAudit) {
+	if err := append_json_line(UserAuditFile, audit); err != nil {
+		event_log("user").Error(err)
+	}
+}
+
+// append_json_line appends v as a line of json to filename and syncs it
+func append_json_line(filename string, v interface{}) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// names are substituted into topic and method globs, e.g. {name}@*
+func valid_user_name(name string) bool {
+	return name != "" && name != SystemName && !strings.ContainsAny(name, "@:|,\t*?[]{}\\")
+}
+
+// admin/user/list -> OK{|name	comment	mask	roles}	roles: separated by ','
+// admin/user/add|name|comment|mask{|roles} -> OK|token
+// admin/user/rm|name[|comment] -> OK
+// admin/user/rotate|name|comment -> OK|token
+// admin/user/roles|name|comment|mask{|roles} -> OK
+//
+// mutate runs fn on the users of the auth file as it is on disk, which are
+// validated, written back and applied if fn returns OK. Every change is appended to
+// $WEBASIS_USER_AUDIT_FILE.
+func EnableUserAdmin(rpc *wrpc.Server, mutate func(fn func(model AuthModel) wrpc.Resp) wrpc.Resp, model func() AuthModel) {
+	audited := func(r wrpc.Req, action string, fn func(model AuthModel) wrpc.Resp) wrpc.Resp {
+		resp := mutate(fn)
+		if resp.Status != wrpc.StatusOK {
+			return resp
+		}
+
+		caller, _ := wrbac.FromToken(r.Token)
+		fields := webasis.Fields(r.Args)
+		audit := userAudit{
+			Time:    time.Now().Unix(),
+			Caller:  caller,
+			Action:  action,
+			Name:    fields.Get(0, ""),
+			Comment: fields.Get(1, ""),
+			Mask:    fields.Get(2, ""),
+		}
+		if action == "add" || action == "roles" {
+			audit.Roles = r.Args[3:]
+		}
+		write_user_audit(audit)
+		event_log("user").WithField("caller", caller).WithField("action", action).WithField("name", audit.Name).Info("admin/user")
+		return resp
+	}
+
+	rpc.HandleFunc("admin/user/list", func(r wrpc.Req) wrpc.Resp {
+		rets := make([]string, 0)
+		for name, client := range model() {
+			for desc, user := range client {
+				rets = append(rets, strings.Join([]string{name, desc, user.Mask, strings.Join(user.Roles, ",")}, "\t"))
+			}
+		}
+		sort.Strings(rets)
+		return wret.OK(rets...)
+	})
+
+	rpc.HandleFunc("admin/user/add", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 3 || !valid_user_name(r.Args[0]) || r.Args[1] == "" {
+			return wret.Error("args")
+		}
+		name, desc, mask := r.Args[0], r.Args[1], r.Args[2]
+		roles := append([]string{}, r.Args[3:]...)
+
+		secret := new_secret()
+		hash, err := hash_secret(secret)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+
+		return audited(r, "add", func(model AuthModel) wrpc.Resp {
+			if _, ok := model[name][desc]; ok {
+				return wret.Error("exists")
+			}
+			if model[name] == nil {
+				model[name] = make(map[string]User)
+			}
+			model[name][desc] = User{Hash: hash, Mask: mask, Roles: roles}
+			return wret.OK(wrbac.ToToken(name, secret))
+		})
+	})
+
+	rpc.HandleFunc("admin/user/rm", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return wret.Error("args")
+		}
+		name := r.Args[0]
+		desc := webasis.Fields(r.Args).Get(1, "")
+
+		return audited(r, "rm", func(model AuthModel) wrpc.Resp {
+			if _, ok := model[name]; !ok {
+				return wret.Error("not_found")
+			}
+			if desc == "" {
+				delete(model, name)
+				return wret.OK()
+			}
+
+			if _, ok := model[name][desc]; !ok {
+				return wret.Error("not_found")
+			}
+			delete(model[name], desc)
+			if len(model[name]) == 0 {
+				delete(model, name)
+			}
+			return wret.OK()
+		})
+	})
+
+	rpc.HandleFunc("admin/user/rotate", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) != 2 {
+			return wret.Error("args")
+		}
+		name, desc := r.Args[0], r.Args[1]
+
+		secret := new_secret()
+		hash, err := hash_secret(secret)
+		if err != nil {
+			return wret.IError(err.Error())
+		}
+
+		return audited(r, "rotate", func(model AuthModel) wrpc.Resp {
+			user, ok := model[name][desc]
+			if !ok {
+				return wret.Error("not_found")
+			}
+			user.Hash = hash
+			user.Secret = ""
+			model[name][desc] = user
+			return wret.OK(wrbac.ToToken(name, secret))
+		})
+	})
+
+	rpc.HandleFunc("admin/user/roles", func(r wrpc.Req) wrpc.Resp {
+		if len(r.Args) < 3 {
+			return wret.Error("args")
+		}
+		name, desc, mask := r.Args[0], r.Args[1], r.Args[2]
+		roles := append([]string{}, r.Args[3:]...)
+
+		return audited(r, "roles", func(model AuthModel) wrpc.Resp {
+			user, ok := model[name][desc]
+			if !ok {
+				return wret.Error("not_found")
+			}
+			user.Mask = mask
+			user.Roles = roles
+			model[name][desc] = user
+			return wret.OK()
+		})
+	})
+}
+
+func user() {
+	cmd := "help"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	ctx := context.TODO()
+	switch cmd {
+	case "list", "ls":
+		users, err := webasis.UserList(ctx)
+		ExitIfErr(err)
+
+		table := new_output("name", "comment", "mask", "roles")
+		for _, u := range users {
+			table.AddRow(map[string]interface{}{
+				"name":    u.Name,
+				"comment": u.Comment,
+				"mask":    u.Mask,
+				"roles":   strings.Join(u.Roles, ","),
+			})
+		}
+		table.Print()
+	case "add":
+		if len(os.Args) < 5 {
+			user_help()
+			return
+		}
+		token, err := webasis.UserAdd(ctx, os.Args[2], os.Args[3], os.Args[4], os.Args[5:]...)
+		ExitIfErr(err)
+		print_value("token", token)
+	case "rm", "remove", "delete":
+		if len(os.Args) < 3 {
+			user_help()
+			return
+		}
+		desc := ""
+		if len(os.Args) > 3 {
+			desc = os.Args[3]
+		}
+		ExitIfErr(webasis.UserRemove(ctx, os.Args[2], desc))
+	case "rotate":
+		if len(os.Args) < 4 {
+			user_help()
+			return
+		}
+		token, err := webasis.UserRotate(ctx, os.Args[2], os.Args[3])
+		ExitIfErr(err)
+		print_value("token", token)
+	case "roles":
+		if len(os.Args) < 5 {
+			user_help()
+			return
+		}
+		ExitIfErr(webasis.UserRoles(ctx, os.Args[2], os.Args[3], os.Args[4], os.Args[5:]...))
+	default:
+		user_help()
+	}
+}
+
+func user_help() {
+	fmt.Println("help:")
+	fmt.Println("\t", cliName+" list|ls")
+	fmt.Println("\t", cliName+" add name comment mask {roles}")
+	fmt.Println("\t", cliName+" rm|remove|delete name [comment]")
+	fmt.Println("\t", cliName+" rotate name comment")
+	fmt.Println("\t", cliName+" roles name comment mask {roles}")
+	exit_usage()
+}
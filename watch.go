@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/webasis/webasis/webasis"
+	"github.com/webasis/wrbac"
+	"github.com/webasis/wsync"
+)
+
+const (
+	watchSamples       = 60 // of the rate sparklines, about one a second
+	watchTop           = 8  // rows of each table
+	watchNotifications = 5
+)
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+func sparkline(values []float64) string {
+	max := 0.0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+
+	line := make([]rune, len(values))
+	for i, v := range values {
+		line[i] = sparks[0]
+		if max > 0 {
+			line[i] = sparks[int(v/max*float64(len(sparks)-1)+0.5)]
+		}
+	}
+	return string(line)
+}
+
+func is_terminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+type watchNotification struct {
+	Time    time.Time `json:"time"`
+	Content string    `json:"content"`
+}
+
+// watchState is owned by the loop of watch
+type watchState struct {
+	status    webasis.Status
+	fetched   time.Time
+	connected int
+	message   int
+	called    int
+
+	pushed       time.Time // of the last counters
+	sampled      time.Time
+	messageRates []float64
+	callRates    []float64
+
+	notifications []watchNotification
+}
+
+func (st *watchState) add_sample(message, call float64) {
+	st.messageRates = append(st.messageRates, message)
+	st.callRates = append(st.callRates, call)
+	if len(st.messageRates) > watchSamples {
+		st.messageRates = st.messageRates[1:]
+		st.callRates = st.callRates[1:]
+	}
+	st.sampled = time.Now()
+}
+
+func (st *watchState) push(metas []string) {
+	fields := webasis.Fields(metas)
+	connected, message, called := fields.Int(0, st.connected), fields.Int(1, st.message), fields.Int(2, st.called)
+
+	elapsed := time.Since(st.pushed).Seconds()
+	if elapsed < 1 {
+		elapsed = 1
+	}
+	st.add_sample(float64(message-st.message)/elapsed, float64(called-st.called)/elapsed)
+	st.connected, st.message, st.called = connected, message, called
+	st.pushed = time.Now()
+}
+
+// rate is the latest sample, 0 before any
+func rate(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	return samples[len(samples)-1]
+}
+
+func (st *watchState) uptime() time.Duration {
+	return (st.status.Server.Uptime + time.Since(st.fetched)).Truncate(time.Second)
+}
+
+func (st *watchState) plain_line() string {
+	return fmt.Sprintf("%s connected=%d messages=%d (%.1f/s) calls=%d (%.1f/s) logs=%d",
+		time.Now().Format("15:04:05"),
+		st.connected,
+		st.message, rate(st.messageRates),
+		st.called, rate(st.callRates),
+		st.status.WebLog.Logs)
+}
+
+func (st *watchState) render() {
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+	}
+	top := func(n int) int {
+		if n > watchTop {
+			return watchTop
+		}
+		return n
+	}
+	s := st.status
+
+	fmt.Print("\x1B[H\x1B[2J")
+	fmt.Printf("webasis %s  %s %s  up %s  %s\n\n", webasis.WRPCServerURL, s.Server.Version, s.Server.GoVersion, st.uptime(), time.Now().Format("15:04:05"))
+	fmt.Printf("connected  %d\n", st.connected)
+	fmt.Printf("messages   %-10d %s %.1f/s\n", st.message, sparkline(st.messageRates), rate(st.messageRates))
+	fmt.Printf("calls      %-10d %s %.1f/s\n", st.called, sparkline(st.callRates), rate(st.callRates))
+	fmt.Printf("weblogs    %d logs, %d closed, %d bytes, %d lines\n\n", s.WebLog.Logs, s.WebLog.Closed, s.WebLog.Size, s.WebLog.Lines)
+
+	fmt.Println("methods")
+	table := new_output("method", "calls", "errors", "p50/ms", "p90/ms", "p99/ms")
+	for _, stat := range s.Methods[:top(len(s.Methods))] {
+		table.AddRow(map[string]interface{}{
+			"method": stat.Method,
+			"calls":  stat.Calls,
+			"errors": stat.Errors,
+			"p50/ms": ms(stat.P50),
+			"p90/ms": ms(stat.P90),
+			"p99/ms": ms(stat.P99),
+		})
+	}
+	table.Print()
+
+	fmt.Println("errors")
+	table = new_output("status", "reason", "count")
+	for _, stat := range s.Errors[:top(len(s.Errors))] {
+		table.AddRow(map[string]interface{}{"status": stat.Status, "reason": stat.Reason, "count": stat.Count})
+	}
+	table.Print()
+
+	fmt.Println("users")
+	table = new_output("name", "calls", "errors")
+	for _, stat := range s.Users[:top(len(s.Users))] {
+		table.AddRow(map[string]interface{}{"name": stat.Name, "calls": stat.Calls, "errors": stat.Errors})
+	}
+	table.Print()
+
+	fmt.Println("logs")
+	// the columns of log ls, json output has the status as is
+	table = new_output("id", "name", "size", "line", "closed", "created")
+	for _, stat := range s.Logs {
+		table.AddRow(map[string]interface{}{
+			"id":      stat.Id,
+			"name":    stat.Name,
+			"size":    stat.Size,
+			"line":    stat.Line,
+			"closed":  stat.Closed,
+			"created": stat.Created.Unix(),
+		})
+	}
+	table.Print()
+
+	fmt.Println("notifications")
+	for _, n := range st.notifications {
+		fmt.Println(n.Time.Format("15:04:05"), n.Content)
+	}
+}
+
+// watch fetches the status once and then whenever the daemon pushes a change
+// of its counters or logs, at most once a second. It is a full screen view on
+// a terminal, a line per change otherwise.
+func watch() {
+	tui := OutputFormat == "table" && is_terminal(os.Stdout)
+	plain := OutputFormat == "table" && !tui
+
+	status, err := webasis.StatusAll(context.TODO(), watchTop)
+	ExitIfErr(err)
+	st := &watchState{
+		status:    status,
+		fetched:   time.Now(),
+		connected: status.Connected,
+		message:   status.Message,
+		called:    status.Called,
+		pushed:    time.Now(),
+		sampled:   time.Now(),
+	}
+
+	out := new_output("time", "status", "message_rate", "call_rate", "notifications")
+	show := func() {
+		switch {
+		case tui:
+			st.render()
+		case plain:
+			fmt.Println(st.plain_line())
+		default:
+			out.PrintRow(map[string]interface{}{
+				"time":          time.Now(),
+				"status":        st.status,
+				"message_rate":  rate(st.messageRates),
+				"call_rate":     rate(st.callRates),
+				"notifications": st.notifications,
+			})
+		}
+	}
+
+	if tui {
+		// the alternate screen, without the cursor
+		fmt.Print("\x1B[?1049h\x1B[?25l")
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-sig
+			fmt.Print("\x1B[?25h\x1B[?1049l")
+			os.Exit(exitOK)
+		}()
+	}
+
+	ch := make(chan func(), 100)
+	stale := false // the status is older than a push
+	fetching := false
+
+	name, _ := wrbac.FromToken(webasis.Token)
+	sync := wsync.NewClient(webasis.WSyncServerURL, webasis.Token)
+	sync.AfterOpen = func(_ *websocket.Conn) {
+		go sync.Sub(webasis.StatusTopic, "logs", name+"@notification")
+	}
+	sync.OnTopic = func(topic string, metas ...string) {
+		ch <- func() {
+			switch topic {
+			case webasis.StatusTopic:
+				st.push(metas)
+				stale = true
+				if plain {
+					fmt.Println(st.plain_line())
+				}
+			case "logs":
+				stale = true
+			default:
+				if len(metas) == 0 {
+					return
+				}
+				n := watchNotification{Time: time.Now(), Content: metas[0]}
+				st.notifications = append([]watchNotification{n}, st.notifications...)
+				if len(st.notifications) > watchNotifications {
+					st.notifications = st.notifications[:watchNotifications]
+				}
+				if plain {
+					fmt.Println(n.Time.Format("15:04:05"), "notification:", n.Content)
+				} else {
+					show()
+				}
+			}
+		}
+	}
+	go func() {
+		for {
+			sync.Serve()
+		}
+	}()
+
+	go func() {
+		for range time.Tick(time.Second) {
+			ch <- func() {
+				// no push means no change
+				if time.Since(st.sampled) >= time.Second*2 {
+					st.add_sample(0, 0)
+				}
+				if tui {
+					st.render()
+				}
+
+				if !stale || fetching {
+					return
+				}
+				stale, fetching = false, true
+				go func() {
+					status, err := webasis.StatusAll(context.TODO(), watchTop)
+					ch <- func() {
+						fetching = false
+						if err != nil {
+							return
+						}
+						st.status, st.fetched = status, time.Now()
+						if !plain {
+							show()
+						}
+					}
+				}()
+			}
+		}
+	}()
+
+	show()
+	for fn := range ch {
+		fn()
+	}
+}
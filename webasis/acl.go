@@ -0,0 +1,39 @@
+package webasis
+
+import (
+	"context"
+	"strings"
+)
+
+type LogGrantEntry struct {
+	Grantee string // user:{name}|role:{role}
+	Perm    string // read|append|admin
+}
+
+func LogACL(ctx context.Context, id string) (grants []LogGrantEntry, err error) {
+	resp, err := Call(ctx, "log/acl", id)
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	grants = make([]LogGrantEntry, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		fields := Fields(strings.SplitN(ret, "\t", 2))
+		grants[i] = LogGrantEntry{
+			Grantee: fields.Get(0, ""),
+			Perm:    fields.Get(1, ""),
+		}
+	}
+	return grants, nil
+}
+
+func LogGrant(ctx context.Context, id, grantee, perm string) error {
+	resp, err := Call(ctx, "log/acl/grant", id, grantee, perm)
+	return resp.Error(err, 0)
+}
+
+func LogRevoke(ctx context.Context, id, grantee string) error {
+	resp, err := Call(ctx, "log/acl/revoke", id, grantee)
+	return resp.Error(err, 0)
+}
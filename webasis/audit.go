@@ -0,0 +1,37 @@
+package webasis
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry is a line of the audit log, encoded in json
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Caller  string    `json:"caller"`
+	Method  string    `json:"method"`
+	Args    []string  `json:"args"` // summary, long args are cut
+	Status  string    `json:"status"`
+	Remote  string    `json:"remote"`
+	Latency int64     `json:"latency_ms"`
+}
+
+// AuditQuery returns the latest max_num entries, filtered by caller and a
+// method glob if they are not empty
+func AuditQuery(ctx context.Context, max_num int, caller, method string) (entries []AuditEntry, err error) {
+	resp, err := Call(ctx, "admin/audit", Int(max_num), caller, method)
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	entries = make([]AuditEntry, 0, len(resp.Rets))
+	for _, ret := range resp.Rets {
+		var entry AuditEntry
+		if json.Unmarshal([]byte(ret), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,13 @@
+package webasis
+
+import "time"
+
+// DaemonEvent is a line of the daemon's event log system@events, encoded in
+// json. Follow it with `webasis log watch system@events`.
+type DaemonEvent struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"` // info|warn|error
+	Kind    string                 `json:"kind"`  // the part of the daemon, e.g. auth
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
@@ -0,0 +1,54 @@
+package webasis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// Health of GET /healthz and /readyz
+type Health struct {
+	Status string            `json:"status"`           // ok|fail
+	Checks map[string]string `json:"checks,omitempty"` // map[name]ok|error, of /readyz
+}
+
+var ErrUnhealthy = errors.New("unhealthy")
+
+// HealthURL is next to WRPCServerURL, e.g. http://localhost:8111/readyz
+func HealthURL(live bool) string {
+	path := "/readyz"
+	if live {
+		path = "/healthz"
+	}
+	return strings.TrimSuffix(WRPCServerURL, "/wrpc") + path
+}
+
+// CheckHealth returns ErrUnhealthy with the health the daemon answered when
+// it is not ok
+func CheckHealth(ctx context.Context, live bool) (health Health, err error) {
+	req, err := http.NewRequest("GET", HealthURL(live), nil)
+	if err != nil {
+		return Health{}, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return Health{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return Health{}, fmt.Errorf("%s: %s", req.URL, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || health.Status != HealthOK {
+		return health, ErrUnhealthy
+	}
+	return health, nil
+}
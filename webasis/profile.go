@@ -0,0 +1,140 @@
+package webasis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/webasis/wrpc"
+)
+
+// Profile is a daemon to talk to. Empty values fall back to the environment.
+type Profile struct {
+	WRPCServerURL  string `json:"wrpc_server_url,omitempty"`
+	WSyncServerURL string `json:"wsync_server_url,omitempty"`
+	Token          string `json:"token,omitempty"`
+	TokenFile      string `json:"token_file,omitempty"` // used if token is empty
+	CAFile         string `json:"ca_file,omitempty"`    // pem of CAs trusted besides the system ones
+}
+
+// ClientConfig is the file of ClientConfigFile
+type ClientConfig struct {
+	Default  string             `json:"default,omitempty"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+var (
+	ClientConfigFile = getenv("WEBASIS_CLIENT_CONFIG", default_client_config_file())
+	ProfileName      = getenv("WEBASIS_PROFILE", "") // the one in use after UseProfile
+)
+
+func default_client_config_file() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "webasis", "profiles.json")
+}
+
+// LoadClientConfig returns an empty config if ClientConfigFile doesn't exist
+func LoadClientConfig() (ClientConfig, error) {
+	cfg := ClientConfig{Profiles: make(map[string]Profile)}
+	if ClientConfigFile == "" {
+		return cfg, nil
+	}
+	raw, err := ioutil.ReadFile(ClientConfigFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %s", ClientConfigFile, err)
+	}
+	return cfg, nil
+}
+
+// ProfileNames returns names of the profiles, sorted
+func (cfg ClientConfig) ProfileNames() []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UseProfile makes Call and the server urls use the profile name. An empty
+// name means WEBASIS_PROFILE, then the default of the client config, then
+// the environment only.
+func UseProfile(name string) error {
+	cfg, err := LoadClientConfig()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = ProfileName
+	}
+	if name == "" {
+		name = cfg.Default
+	}
+	if name == "" {
+		return nil
+	}
+
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		return errors.New("unknown profile: " + name)
+	}
+
+	token := p.Token
+	if token == "" && p.TokenFile != "" {
+		raw, err := ioutil.ReadFile(p.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+
+	if p.CAFile != "" {
+		raw, err := ioutil.ReadFile(p.CAFile)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(raw) {
+			return errors.New("no certificate in " + p.CAFile)
+		}
+		tlsConfig := &tls.Config{RootCAs: pool}
+		if transport, ok := http.DefaultTransport.(*http.Transport); ok {
+			transport.TLSClientConfig = tlsConfig
+		}
+		websocket.DefaultDialer.TLSClientConfig = tlsConfig
+	}
+
+	if p.WRPCServerURL != "" {
+		WRPCServerURL = p.WRPCServerURL
+	}
+	if p.WSyncServerURL != "" {
+		WSyncServerURL = p.WSyncServerURL
+	}
+	if token != "" {
+		Token = token
+	}
+	ProfileName = name
+	rpc = wrpc.NewClient(WRPCServerURL, Token)
+	return nil
+}
@@ -0,0 +1,59 @@
+package webasis
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+type ScheduleJob struct {
+	Id      string
+	Kind    string // at|in|cron
+	Spec    string
+	Next    time.Time
+	Content string
+}
+
+func (job ScheduleJob) Encode() string {
+	return strings.Join([]string{job.Id, job.Kind, job.Spec, Int(int(job.Next.Unix())), job.Content}, "\t")
+}
+
+func DecodeScheduleJob(raw string) ScheduleJob {
+	fields := Fields(strings.SplitN(raw, "\t", 5))
+	return ScheduleJob{
+		Id:      fields.Get(0, ""),
+		Kind:    fields.Get(1, ""),
+		Spec:    fields.Get(2, ""),
+		Next:    time.Unix(int64(fields.Int(3, 0)), 0),
+		Content: fields.Get(4, ""),
+	}
+}
+
+// kind: at|in|cron
+func NotifySchedule(ctx context.Context, kind, spec, content string) (id string, err error) {
+	resp, err := Call(ctx, "notify/schedule", kind, spec, content)
+	err = resp.Error(err, 1)
+	if err != nil {
+		return "", err
+	}
+	return resp.Rets[0], nil
+}
+
+func NotifySchedules(ctx context.Context) (jobs []ScheduleJob, err error) {
+	resp, err := Call(ctx, "notify/schedules")
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs = make([]ScheduleJob, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		jobs[i] = DecodeScheduleJob(ret)
+	}
+	return jobs, nil
+}
+
+func NotifyCancel(ctx context.Context, id string) error {
+	resp, err := Call(ctx, "notify/cancel", id)
+	return resp.Error(err, 0)
+}
@@ -0,0 +1,53 @@
+package webasis
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+type LogShareLink struct {
+	Id      string
+	Created time.Time
+	Expires time.Time // zero means never
+}
+
+// ttl is a duration, empty means the link never expires
+func LogLink(ctx context.Context, id, ttl string) (linkId, url string, err error) {
+	args := []string{id}
+	if ttl != "" {
+		args = append(args, ttl)
+	}
+	resp, err := Call(ctx, "log/link", args...)
+	err = resp.Error(err, 2)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.Rets[0], resp.Rets[1], nil
+}
+
+func LogLinks(ctx context.Context, id string) (links []LogShareLink, err error) {
+	resp, err := Call(ctx, "log/links", id)
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	links = make([]LogShareLink, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		fields := Fields(strings.SplitN(ret, "\t", 3))
+		links[i] = LogShareLink{
+			Id:      fields.Get(0, ""),
+			Created: time.Unix(int64(fields.Int(1, 0)), 0),
+		}
+		if expires := fields.Int(2, 0); expires != 0 {
+			links[i].Expires = time.Unix(int64(expires), 0)
+		}
+	}
+	return links, nil
+}
+
+func LogUnlink(ctx context.Context, id, linkId string) error {
+	resp, err := Call(ctx, "log/unlink", id, linkId)
+	return resp.Error(err, 0)
+}
@@ -0,0 +1,195 @@
+package webasis
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// MethodStat of wrpc calls served over http since the daemon started.
+// Percentiles are of the latest calls only, in nanoseconds in json.
+type MethodStat struct {
+	Method string        `json:"method"`
+	Calls  int           `json:"calls"`
+	Errors int           `json:"errors"`
+	P50    time.Duration `json:"p50"`
+	P90    time.Duration `json:"p90"`
+	P99    time.Duration `json:"p99"`
+}
+
+// durations are encoded in microseconds
+func (s MethodStat) Encode() string {
+	us := func(d time.Duration) string { return Int(int(d / time.Microsecond)) }
+	return strings.Join([]string{s.Method, Int(s.Calls), Int(s.Errors), us(s.P50), us(s.P90), us(s.P99)}, "\t")
+}
+
+func DecodeMethodStat(raw string) MethodStat {
+	fields := Fields(strings.SplitN(raw, "\t", 6))
+	us := func(index int) time.Duration { return time.Duration(fields.Int(index, 0)) * time.Microsecond }
+	return MethodStat{
+		Method: fields.Get(0, ""),
+		Calls:  fields.Int(1, 0),
+		Errors: fields.Int(2, 0),
+		P50:    us(3),
+		P90:    us(4),
+		P99:    us(5),
+	}
+}
+
+// ErrorStat counts failed calls by their status and first ret
+type ErrorStat struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+func (s ErrorStat) Encode() string {
+	return strings.Join([]string{s.Status, s.Reason, Int(s.Count)}, "\t")
+}
+
+func DecodeErrorStat(raw string) ErrorStat {
+	fields := Fields(strings.SplitN(raw, "\t", 3))
+	return ErrorStat{
+		Status: fields.Get(0, ""),
+		Reason: fields.Get(1, ""),
+		Count:  fields.Int(2, 0),
+	}
+}
+
+// UserStat counts calls by the user name of their token
+type UserStat struct {
+	Name   string `json:"name"`
+	Calls  int    `json:"calls"`
+	Errors int    `json:"errors"`
+}
+
+func (s UserStat) Encode() string {
+	return strings.Join([]string{s.Name, Int(s.Calls), Int(s.Errors)}, "\t")
+}
+
+func DecodeUserStat(raw string) UserStat {
+	fields := Fields(strings.SplitN(raw, "\t", 3))
+	return UserStat{
+		Name:   fields.Get(0, ""),
+		Calls:  fields.Int(1, 0),
+		Errors: fields.Int(2, 0),
+	}
+}
+
+type ServerStat struct {
+	Started   time.Time     `json:"started"`
+	Uptime    time.Duration `json:"uptime"`
+	Version   string        `json:"version"`
+	GoVersion string        `json:"go_version"`
+}
+
+type WebLogTotals struct {
+	Logs   int `json:"logs"`
+	Closed int `json:"closed"`
+	Size   int `json:"size"`
+	Lines  int `json:"lines"`
+}
+
+func StatusMethods(ctx context.Context) (stats []MethodStat, err error) {
+	resp, err := Call(ctx, "admin/status/wrpc/methods")
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	stats = make([]MethodStat, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		stats[i] = DecodeMethodStat(ret)
+	}
+	return stats, nil
+}
+
+func StatusErrors(ctx context.Context) (stats []ErrorStat, err error) {
+	resp, err := Call(ctx, "admin/status/wrpc/errors")
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	stats = make([]ErrorStat, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		stats[i] = DecodeErrorStat(ret)
+	}
+	return stats, nil
+}
+
+func StatusUsers(ctx context.Context) (stats []UserStat, err error) {
+	resp, err := Call(ctx, "admin/status/wrpc/users")
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	stats = make([]UserStat, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		stats[i] = DecodeUserStat(ret)
+	}
+	return stats, nil
+}
+
+func StatusServer(ctx context.Context) (stat ServerStat, err error) {
+	resp, err := Call(ctx, "admin/status/server")
+	err = resp.Error(err, 4)
+	if err != nil {
+		return ServerStat{}, err
+	}
+
+	fields := Fields(resp.Rets)
+	return ServerStat{
+		Started:   time.Unix(int64(fields.Int(0, 0)), 0),
+		Uptime:    time.Duration(fields.Int(1, 0)) * time.Second,
+		Version:   fields.Get(2, ""),
+		GoVersion: fields.Get(3, ""),
+	}, nil
+}
+
+func StatusWebLog(ctx context.Context) (totals WebLogTotals, err error) {
+	resp, err := Call(ctx, "admin/status/weblog")
+	err = resp.Error(err, 4)
+	if err != nil {
+		return WebLogTotals{}, err
+	}
+
+	fields := Fields(resp.Rets)
+	return WebLogTotals{
+		Logs:   fields.Int(0, 0),
+		Closed: fields.Int(1, 0),
+		Size:   fields.Int(2, 0),
+		Lines:  fields.Int(3, 0),
+	}, nil
+}
+
+// StatusTopic is boardcast by the daemon when its counters change, metas are
+// wsync_connected|wsync_message|wrpc_called
+const StatusTopic = "system@status"
+
+// Status of the daemon in one call, see the Status* functions
+type Status struct {
+	Server    ServerStat   `json:"server"`
+	Connected int          `json:"wsync_connected"`
+	Message   int          `json:"wsync_message"`
+	Called    int          `json:"wrpc_called"`
+	WebLog    WebLogTotals `json:"weblog"`
+	Logs      []WebLogStat `json:"logs"` // the latest created first
+	Methods   []MethodStat `json:"methods"`
+	Errors    []ErrorStat  `json:"errors"`
+	Users     []UserStat   `json:"users"`
+}
+
+// StatusAll returns at most max_logs logs, 0 means none
+func StatusAll(ctx context.Context, max_logs int) (status Status, err error) {
+	resp, err := Call(ctx, "admin/status", Int(max_logs))
+	err = resp.Error(err, 1)
+	if err != nil {
+		return Status{}, err
+	}
+
+	err = json.Unmarshal([]byte(resp.Rets[0]), &status)
+	return status, err
+}
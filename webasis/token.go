@@ -0,0 +1,77 @@
+package webasis
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+type ScopedToken struct {
+	Id      string
+	Name    string
+	Comment string
+	Expires time.Time
+	Roles   []string
+	Methods []string
+	Topics  []string
+}
+
+func (t ScopedToken) Encode() string {
+	return strings.Join([]string{
+		t.Id,
+		t.Name,
+		t.Comment,
+		Int(int(t.Expires.Unix())),
+		strings.Join(t.Roles, ","),
+		strings.Join(t.Methods, ","),
+		strings.Join(t.Topics, ","),
+	}, "\t")
+}
+
+func DecodeScopedToken(raw string) ScopedToken {
+	fields := Fields(strings.SplitN(raw, "\t", 7))
+	split := func(v string) []string {
+		if v == "" {
+			return nil
+		}
+		return strings.Split(v, ",")
+	}
+	return ScopedToken{
+		Id:      fields.Get(0, ""),
+		Name:    fields.Get(1, ""),
+		Comment: fields.Get(2, ""),
+		Expires: time.Unix(int64(fields.Int(3, 0)), 0),
+		Roles:   split(fields.Get(4, "")),
+		Methods: split(fields.Get(5, "")),
+		Topics:  split(fields.Get(6, "")),
+	}
+}
+
+// roles, methods and topics are separated by ','
+func TokenMint(ctx context.Context, ttl, roles, methods, topics, comment string) (id, token string, err error) {
+	resp, err := Call(ctx, "token/mint", ttl, roles, methods, topics, comment)
+	err = resp.Error(err, 2)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.Rets[0], resp.Rets[1], nil
+}
+
+func TokenList(ctx context.Context) (tokens []ScopedToken, err error) {
+	resp, err := Call(ctx, "token/list")
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens = make([]ScopedToken, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		tokens[i] = DecodeScopedToken(ret)
+	}
+	return tokens, nil
+}
+
+func TokenRevoke(ctx context.Context, id string) error {
+	resp, err := Call(ctx, "token/revoke", id)
+	return resp.Error(err, 0)
+}
@@ -0,0 +1,75 @@
+package webasis
+
+import (
+	"context"
+	"strings"
+)
+
+type UserEntry struct {
+	Name    string
+	Comment string
+	Mask    string
+	Roles   []string
+}
+
+func DecodeUserEntry(raw string) UserEntry {
+	fields := Fields(strings.SplitN(raw, "\t", 4))
+	entry := UserEntry{
+		Name:    fields.Get(0, ""),
+		Comment: fields.Get(1, ""),
+		Mask:    fields.Get(2, ""),
+	}
+	if roles := fields.Get(3, ""); roles != "" {
+		entry.Roles = strings.Split(roles, ",")
+	}
+	return entry
+}
+
+func UserList(ctx context.Context) (users []UserEntry, err error) {
+	resp, err := Call(ctx, "admin/user/list")
+	err = resp.Error(err, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	users = make([]UserEntry, len(resp.Rets))
+	for i, ret := range resp.Rets {
+		users[i] = DecodeUserEntry(ret)
+	}
+	return users, nil
+}
+
+func UserAdd(ctx context.Context, name, comment, mask string, roles ...string) (token string, err error) {
+	args := append([]string{name, comment, mask}, roles...)
+	resp, err := Call(ctx, "admin/user/add", args...)
+	err = resp.Error(err, 1)
+	if err != nil {
+		return "", err
+	}
+	return resp.Rets[0], nil
+}
+
+// remove all tokens of name if comment is empty
+func UserRemove(ctx context.Context, name, comment string) error {
+	args := []string{name}
+	if comment != "" {
+		args = append(args, comment)
+	}
+	resp, err := Call(ctx, "admin/user/rm", args...)
+	return resp.Error(err, 0)
+}
+
+func UserRotate(ctx context.Context, name, comment string) (token string, err error) {
+	resp, err := Call(ctx, "admin/user/rotate", name, comment)
+	err = resp.Error(err, 1)
+	if err != nil {
+		return "", err
+	}
+	return resp.Rets[0], nil
+}
+
+func UserRoles(ctx context.Context, name, comment, mask string, roles ...string) error {
+	args := append([]string{name, comment, mask}, roles...)
+	resp, err := Call(ctx, "admin/user/roles", args...)
+	return resp.Error(err, 0)
+}
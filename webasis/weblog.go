@@ -51,7 +51,7 @@ func LogGet(ctx context.Context, id string, index, max_num, max_size int) (logs
 
 func LogStat(ctx context.Context, id string) (stat WebLogStat, err error) {
 	resp, err := Call(ctx, "log/stat", id)
-	err = resp.Error(err, 5)
+	err = resp.Error(err, 5) // first is 6th, daemons before it answer 5
 	if err != nil {
 		return WebLogStat{}, err
 	}
@@ -65,23 +65,25 @@ func LogStat(ctx context.Context, id string) (stat WebLogStat, err error) {
 		Line:    fields.Int(2, 0),
 		Closed:  fields.Bool(3, true),
 		Created: time.Unix(int64(fields.Int(4, 0)), 0),
+		First:   fields.Int(5, 0), // nothing dropped if absent
 	}, nil
 }
 
 type WebLogStat struct {
-	Id      string
-	Name    string
-	Closed  bool
-	Size    int
-	Line    int
-	Created time.Time
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Closed  bool      `json:"closed"`
+	Size    int       `json:"size"`
+	Line    int       `json:"line"`  // appended ever
+	First   int       `json:"first"` // the oldest kept line, lines before it were dropped
+	Created time.Time `json:"created"`
 }
 
 func (stat WebLogStat) Encode() string {
-	return strings.Join([]string{stat.Id, stat.Name, Int(stat.Size), Int(stat.Line), Bool(stat.Closed), Int(int(stat.Created.Unix()))}, ",")
+	return strings.Join([]string{stat.Id, stat.Name, Int(stat.Size), Int(stat.Line), Bool(stat.Closed), Int(int(stat.Created.Unix())), Int(stat.First)}, ",")
 }
 func DecodeWebLogStat(raw string) WebLogStat {
-	data := strings.SplitN(raw, ",", 6)
+	data := strings.SplitN(raw, ",", 7)
 	fields := Fields(data)
 	return WebLogStat{
 		Id:      fields.Get(0, ""),
@@ -90,6 +92,7 @@ func DecodeWebLogStat(raw string) WebLogStat {
 		Line:    fields.Int(3, 0),
 		Closed:  fields.Bool(4, true),
 		Created: time.Unix(int64(fields.Int(5, 0)), 0),
+		First:   fields.Int(6, 0),
 	}
 }
 
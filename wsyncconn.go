@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// wsync does not expose its agents' tokens or connections, so syncConns
+// records every hijacked /wsync connection with the token of its handshake.
+type syncConns struct {
+	ch     chan func()
+	conns  map[net.Conn]string // map[conn]token
+	opened int                 // since the last Churn
+	closed int
+}
+
+func new_sync_conns() *syncConns {
+	c := &syncConns{
+		ch:    make(chan func(), 100),
+		conns: make(map[net.Conn]string),
+	}
+	go func() {
+		for fn := range c.ch {
+			fn()
+		}
+	}()
+	return c
+}
+
+// token of a wsync handshake
+func wsync_token(r *http.Request) string {
+	return r.URL.Query().Get("token")
+}
+
+// Wrap records connections upgraded by h
+func (c *syncConns) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&hijackRecorder{
+			ResponseWriter: w,
+			onHijack: func(conn net.Conn) net.Conn {
+				// timeouts of the http server are for requests, not for agents
+				conn.SetDeadline(time.Time{})
+				return c.track(conn, wsync_token(r))
+			},
+		}, r)
+	})
+}
+
+// track records conn until it is closed
+func (c *syncConns) track(conn net.Conn, token string) net.Conn {
+	tracked := &trackedConn{Conn: conn}
+	tracked.onClose = func() {
+		c.ch <- func() {
+			// it may be closed twice
+			if _, ok := c.conns[tracked]; ok {
+				delete(c.conns, tracked)
+				c.closed++
+			}
+		}
+	}
+	c.ch <- func() {
+		c.conns[tracked] = token
+		c.opened++
+	}
+	return tracked
+}
+
+// Len returns the number of open connections
+func (c *syncConns) Len() int {
+	ret := make(chan int, 1)
+	c.ch <- func() {
+		ret <- len(c.conns)
+	}
+	return <-ret
+}
+
+// Churn returns connections opened and closed since its last call and the
+// open ones
+func (c *syncConns) Churn() (opened, closed, open int) {
+	ret := make(chan [3]int, 1)
+	c.ch <- func() {
+		ret <- [3]int{c.opened, c.closed, len(c.conns)}
+		c.opened, c.closed = 0, 0
+	}
+	counts := <-ret
+	return counts[0], counts[1], counts[2]
+}
+
+// CloseIf closes connections whose token is revoked, returns the closed number.
+// revoked may be slow, e.g. bcrypt, so it runs once per distinct token and
+// outside the loop of c.
+func (c *syncConns) CloseIf(revoked func(token string) bool) int {
+	ret := make(chan map[net.Conn]string, 1)
+	c.ch <- func() {
+		conns := make(map[net.Conn]string, len(c.conns))
+		for conn, token := range c.conns {
+			conns[conn] = token
+		}
+		ret <- conns
+	}
+
+	conns := <-ret
+	verdicts := make(map[string]bool) // map[token]revoked
+	closed := 0
+	for conn, token := range conns {
+		v, ok := verdicts[token]
+		if !ok {
+			v = revoked(token)
+			verdicts[token] = v
+		}
+		if v {
+			conn.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// CloseAll closes every connection, returns the closed number. wsync owns
+// their writers, a close frame written here could interleave with theirs, so
+// agents just see the connection drop and reconnect.
+func (c *syncConns) CloseAll() int {
+	ret := make(chan []net.Conn, 1)
+	c.ch <- func() {
+		conns := make([]net.Conn, 0, len(c.conns))
+		for conn := range c.conns {
+			conns = append(conns, conn)
+		}
+		ret <- conns
+	}
+
+	conns := <-ret
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+type hijackRecorder struct {
+	http.ResponseWriter
+	onHijack func(conn net.Conn) net.Conn
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http: hijack is not supported")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	return w.onHijack(conn), rw, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.onClose()
+	return err
+}
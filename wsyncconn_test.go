@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/webasis/wsync"
+)
+
+// syncConns closes connections by the token of their handshake, which must
+// be the token wsync authorizes their calls with
+func TestWSyncHandshakeToken(t *testing.T) {
+	const token = "alice:s3cret/+ ="
+
+	authed := make(chan string, 10)
+	server := wsync.NewServer()
+	server.Auth = func(token string, m wsync.AuthMethod, topic string) bool {
+		authed <- token
+		return true
+	}
+
+	conns := new_sync_conns()
+	ts := httptest.NewServer(conns.Wrap(server))
+	defer ts.Close()
+
+	client := wsync.NewClient("ws"+strings.TrimPrefix(ts.URL, "http"), token)
+	client.AfterOpen = func(_ *websocket.Conn) {
+		go client.Sub("alice@notification")
+	}
+	go client.Serve()
+
+	select {
+	case got := <-authed:
+		if got != token {
+			t.Fatalf("wsync authorized %q, want %q", got, token)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("wsync never authorized the sub")
+	}
+
+	recorded := make(chan []string, 1)
+	conns.ch <- func() {
+		tokens := make([]string, 0, len(conns.conns))
+		for _, token := range conns.conns {
+			tokens = append(tokens, token)
+		}
+		recorded <- tokens
+	}
+	if tokens := <-recorded; len(tokens) != 1 || tokens[0] != token {
+		t.Fatalf("syncConns recorded %q, want [%q]", tokens, token)
+	}
+
+	if n := conns.CloseIf(func(t string) bool { return t == token }); n != 1 {
+		t.Fatalf("CloseIf closed %d connections, want 1", n)
+	}
+}
+
+func TestCloseIfResolvesTokensOnce(t *testing.T) {
+	conns := new_sync_conns()
+	for i := 0; i < 3; i++ {
+		for _, token := range []string{"alice:a", "bob:b"} {
+			a, b := net.Pipe()
+			defer b.Close()
+			conns.track(a, token)
+		}
+	}
+
+	calls := make(map[string]int)
+	n := conns.CloseIf(func(token string) bool {
+		calls[token]++
+		return token == "bob:b"
+	})
+	if n != 3 {
+		t.Errorf("CloseIf closed %d connections, want 3", n)
+	}
+	for token, count := range calls {
+		if count != 1 {
+			t.Errorf("revoked(%q) called %d times, want 1", token, count)
+		}
+	}
+	if left := conns.Len(); left != 3 {
+		t.Errorf("%d connections left, want 3", left)
+	}
+}